@@ -0,0 +1,58 @@
+package csrfbanana
+
+import (
+	"io"
+	"net/http"
+)
+
+// limitedBody reads the body through http.MaxBytesReader until done is set
+type limitedBody struct {
+	body     io.ReadCloser
+	limited  io.ReadCloser
+	max      int64
+	read     int64
+	tooLarge bool
+	done     bool
+}
+
+// Read reads from the limited body until the token is checked
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.done {
+		return b.body.Read(p)
+	}
+
+	n, err := b.limited.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.max {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+// Close closes the original body
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// checkBody checks the token with the body limited to Options.MaxBodyBytes
+func (h *CSRFHandler) checkBody(w http.ResponseWriter, r *http.Request) error {
+	max := h.Options().MaxBodyBytes
+	if max <= 0 || r.Body == nil {
+		return h.check(w, r)
+	}
+
+	b := &limitedBody{
+		body:    r.Body,
+		limited: http.MaxBytesReader(w, r.Body, max),
+		max:     max,
+	}
+	r.Body = b
+
+	err := h.check(w, r)
+	b.done = true
+
+	if b.tooLarge {
+		return ErrBodyTooLarge
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package csrfbanana
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestMaxBodyBytes(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Save the reason passed to the failure handler
+	var reason error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		failureHandler500(w, r)
+	}
+
+	// Read the body in the next handler
+	var body string
+	page := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		successHandler(w, r)
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName, Options{MaxBodyBytes: 8192})
+	h.FailureHandler(http.HandlerFunc(failure))
+
+	// Render the form
+	w := httptest.NewRecorder()
+	get := fakeGet()
+	sess, err := store.Get(get, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	token := h.Token(w, get, sess)
+	cookie := w.Result().Cookies()[0]
+
+	form := url.Values{}
+	form.Set(TokenName, token)
+	form.Set("data", strings.Repeat("a", 4096))
+	largeForm := url.Values{}
+	largeForm.Set(TokenName, token)
+	largeForm.Set("data", strings.Repeat("a", 16384))
+
+	jsonValue := func(data string) string {
+		return `{"token": "` + token + `", "data": "` + data + `"}`
+	}
+	multipart, multipartType := multipartBody(TokenName, token, "file", strings.Repeat("a", 1<<20))
+	largeMultipart, largeMultipartType := multipartBody("title", strings.Repeat("a", 16384), TokenName, token)
+
+	tests := []struct {
+		contentType string
+		body        string
+		err         error
+	}{
+		{"application/x-www-form-urlencoded", form.Encode(), nil},
+		{"application/x-www-form-urlencoded", largeForm.Encode(), ErrBodyTooLarge},
+		{"application/json", jsonValue(strings.Repeat("a", 4096)), nil},
+		{"application/json", jsonValue(strings.Repeat("a", 16384)), ErrBodyTooLarge},
+		{multipartType, multipart, nil},
+		{largeMultipartType, largeMultipart, ErrBodyTooLarge},
+	}
+
+	for i, tt := range tests {
+		reason = nil
+		body = ""
+
+		// Create the POST request
+		req, err := http.NewRequest("POST", "http://localhost/", strings.NewReader(tt.body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+		req.AddCookie(cookie)
+
+		// Run the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if reason != tt.err {
+			t.Errorf("Test %v: expected reason %v, got %v", i, tt.err, reason)
+		}
+
+		// The form is parsed by the middleware, other bodies are passed on
+		if tt.err == nil && !strings.HasPrefix(tt.contentType, "application/x-www-form-urlencoded") && body != tt.body {
+			t.Errorf("Test %v: the next handler should get the whole body, got %v bytes", i, len(body))
+		}
+	}
+}
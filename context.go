@@ -0,0 +1,272 @@
+package csrfbanana
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// contextKey is the type of the keys stored in the request context
+type contextKey int
+
+const (
+	failureReasonKey contextKey = iota
+	requestTokensKey
+)
+
+// requestTokens gives access to the tokens during a request handled by
+// ServeHTTP. The session is loaded the first time it's needed and saved
+// before the response is written.
+type requestTokens struct {
+	h      *CSRFHandler
+	w      http.ResponseWriter
+	r      *http.Request
+	sess   *sessions.Session
+	err    error
+	loaded bool
+	dirty  bool
+
+	// nonces is the nonces in the session when it was loaded
+	nonces map[string]bool
+
+	// written is true once the headers are sent
+	written bool
+	status  Status
+}
+
+// TokenFromRequest returns the token for the current page, like Token, when
+// the request is handled by a CSRFHandler. The session doesn't need to be
+// passed in and is saved at the end of the request. It returns an empty
+// string if the request isn't handled by a CSRFHandler or the session can't
+// be loaded.
+//
+// The response is held back so it can be called while the page is written,
+// like from a template. If the handler flushes or writes more than 64KB, the
+// headers are sent early with the token for the current page. A token for
+// another path created after that can't be saved in a cookie, so call
+// TokenForPath before writing large pages.
+func TokenFromRequest(r *http.Request) string {
+	rt := requestTokensFrom(r)
+	if rt == nil {
+		return ""
+	}
+	return rt.token(tokenPath(r, rt.h.Options()))
+}
+
+// TokenForPath returns the token for the specified URL, like TokenWithPath,
+// when the request is handled by a CSRFHandler
+func TokenForPath(r *http.Request, urlPath string) string {
+	rt := requestTokensFrom(r)
+	if rt == nil {
+		return ""
+	}
+	return rt.token(urlPath)
+}
+
+// requestTokensFrom returns the tokens stored in the request context
+func requestTokensFrom(r *http.Request) *requestTokens {
+	rt, _ := r.Context().Value(requestTokensKey).(*requestTokens)
+	return rt
+}
+
+// session loads the session once per request
+func (rt *requestTokens) session() (*sessions.Session, error) {
+	if !rt.loaded {
+		rt.sess, rt.err = rt.h.loadSession(rt.w, rt.r)
+		rt.loaded = true
+		if rt.err == nil {
+			rt.nonces = nonceSet(rt.sess.Values[rt.h.Options().TokenName])
+		}
+	}
+	return rt.sess, rt.err
+}
+
+// token returns the token for urlPath and marks the session to be saved if
+// a token was generated
+func (rt *requestTokens) token(urlPath string) string {
+	var sess *sessions.Session
+
+	// The double submit cookie doesn't use the session
+	if rt.h.cookie == nil {
+		var err error
+		sess, err = rt.session()
+		if err != nil {
+			return ""
+		}
+	}
+
+	t, changed := rt.h.issue(rt.w, rt.r, sess, urlPath, rt.h.Options())
+	if changed {
+		rt.dirty = true
+
+		// The headers are already sent, so save now. A TokenStore that
+		// keeps the tokens on the server still works, but a new cookie is
+		// lost.
+		if rt.written {
+			rt.save()
+		}
+	}
+	return t
+}
+
+// forget drops the loaded tokens, so they aren't saved again at the end of
+// the request after they were cleared
+func (rt *requestTokens) forget() {
+	if rt.sess != nil {
+		delete(rt.sess.Values, rt.h.Options().TokenName)
+		rt.dirty = false
+	}
+}
+
+// save saves the session if it changed. The error can't be returned to the
+// handler so it is ignored, like the error from Token.
+func (rt *requestTokens) save() {
+	if rt.dirty && rt.sess != nil {
+		rt.dirty = false
+		rt.h.saveTokens(rt.w, rt.r, rt.sess, rt.nonces)
+	}
+}
+
+// bufferLimit is how much of the body tokenWriter holds back, so the tokens
+// created while a page is rendered are saved before the headers are sent
+const bufferLimit = 64 << 10
+
+// tokenWriter holds back the response until the handler returns, so the
+// session is saved with the tokens created while the body was written. If
+// the handler flushes or writes more than bufferLimit, the response is sent
+// early and the token for the page is created first.
+type tokenWriter struct {
+	http.ResponseWriter
+	rt   *requestTokens
+	code int
+	body bytes.Buffer
+}
+
+// WriteHeader holds back the status code until the session is saved
+func (tw *tokenWriter) WriteHeader(code int) {
+	if tw.rt.written {
+		tw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if tw.code == 0 {
+		tw.code = code
+	}
+}
+
+// Write holds back the body until the session is saved
+func (tw *tokenWriter) Write(b []byte) (int, error) {
+	if tw.rt.written {
+		return tw.ResponseWriter.Write(b)
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	tw.body.Write(b)
+	if tw.body.Len() > bufferLimit {
+		tw.send(true)
+	}
+	return len(b), nil
+}
+
+// Flush saves the session and flushes the response if it's supported
+func (tw *tokenWriter) Flush() {
+	tw.send(true)
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish saves the session and sends the response when the handler returns
+func (tw *tokenWriter) finish() {
+	tw.send(false)
+}
+
+// send saves the session and writes what was held back. If the handler
+// isn't done, the token for an HTML page is created first, because a
+// template usually adds it after the body has started.
+func (tw *tokenWriter) send(early bool) {
+	if tw.rt.written {
+		return
+	}
+
+	if early && tw.rt.h.perRequest == 0 && tw.isHTML() {
+		tw.rt.token(tokenPath(tw.rt.r, tw.rt.h.Options()))
+	}
+
+	tw.rt.save()
+	tw.rt.written = true
+
+	if tw.code != 0 {
+		tw.ResponseWriter.WriteHeader(tw.code)
+	}
+	if tw.body.Len() > 0 {
+		tw.ResponseWriter.Write(tw.body.Bytes())
+		tw.body.Reset()
+	}
+}
+
+// ReadFrom sends what was held back and copies the rest of the body with
+// the io.ReaderFrom of the wrapped ResponseWriter, like sendfile for
+// http.FileServer
+func (tw *tokenWriter) ReadFrom(src io.Reader) (int64, error) {
+	tw.send(true)
+	if rf, ok := tw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{tw.ResponseWriter}, src)
+}
+
+// Push starts an HTTP/2 server push if it's supported
+func (tw *tokenWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := tw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the wrapped ResponseWriter for http.ResponseController
+func (tw *tokenWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// writerOnly hides the io.ReaderFrom of a writer, so io.Copy doesn't call it
+type writerOnly struct {
+	io.Writer
+}
+
+// isHTML returns true if the response is an HTML page
+func (tw *tokenWriter) isHTML() bool {
+	contentType := tw.Header().Get("Content-Type")
+	if contentType == "" && tw.body.Len() > 0 {
+		contentType = http.DetectContentType(tw.body.Bytes())
+	}
+	return strings.HasPrefix(strings.ToLower(contentType), "text/html")
+}
+
+// hijackTokenWriter is a tokenWriter for a ResponseWriter that supports
+// hijacking
+type hijackTokenWriter struct {
+	*tokenWriter
+}
+
+// Hijack saves the session and lets the handler take over the connection
+func (tw hijackTokenWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	// Nothing can be written after the connection is taken over
+	tw.rt.save()
+	tw.rt.written = true
+	return tw.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// responseWriter returns the tokenWriter as an http.Hijacker only if the
+// wrapped ResponseWriter is one
+func (tw *tokenWriter) responseWriter() http.ResponseWriter {
+	if _, ok := tw.ResponseWriter.(http.Hijacker); ok {
+		return hijackTokenWriter{tw}
+	}
+	return tw
+}
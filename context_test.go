@@ -0,0 +1,396 @@
+package csrfbanana
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestTokenFromRequest(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// The page gets the tokens without the session
+	var token, token1 string
+	page := func(w http.ResponseWriter, r *http.Request) {
+		token = TokenFromRequest(r)
+		token1 = TokenForPath(r, "/form1")
+		w.Write([]byte("page"))
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName)
+
+	// Run the page
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+
+	if token == "" || token1 == "" || token == token1 {
+		t.Fatalf("Tokens should be set and different, got %q and %q", token, token1)
+	}
+
+	// The session was saved before the body was written
+	r := fakeGet()
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	tokens, ok := sess.Values[TokenName].(TokenMap)
+	if !ok || tokens["/"].Value != token || tokens["/form1"].Value != token1 {
+		t.Errorf("Tokens were not saved: expected %v and %v, got %v", token, token1, sess.Values[TokenName])
+	}
+}
+
+func TestTokenFromRequestNoWrite(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// The page doesn't write anything
+	page := func(w http.ResponseWriter, r *http.Request) {
+		TokenFromRequest(r)
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName)
+
+	// Run the page
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+
+	if len(w.Result().Cookies()) != 1 {
+		t.Errorf("The session should have been saved at the end of the request, got %v", w.Result().Cookies())
+	}
+}
+
+func TestTokenFromRequestWithoutHandler(t *testing.T) {
+	if token := TokenFromRequest(fakeGet()); token != "" {
+		t.Errorf("Token should be empty outside of the handler, got %v", token)
+	}
+	if token := TokenForPath(fakeGet(), "/form1"); token != "" {
+		t.Errorf("Token should be empty outside of the handler, got %v", token)
+	}
+}
+
+func TestTokenFromRequestClearAfterUsage(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(TokenFromRequest(r)))
+	}), store, cookieName)
+	h.ClearAfterUsage(true)
+
+	// Render the form
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+	token := w.Body.String()
+	cookies := w.Result().Cookies()
+
+	// Post the form twice with the same session cookie
+	for i, code := range []int{200, 400} {
+		form := url.Values{}
+		form.Set(TokenName, token)
+		req := fakePost(form)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != code {
+			t.Errorf("Post %d: expected code %d, got %d", i+1, code, w.Code)
+		}
+		if i == 0 {
+			// The session without the used token
+			cookies = w.Result().Cookies()
+		}
+	}
+}
+
+func TestClearDuringRequest(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Render the tokens, or clear them after the form is posted, like on login
+	page := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			sess, _ := store.Get(r, cookieName)
+			Clear(w, r, sess)
+			return
+		}
+		w.Write([]byte(TokenFromRequest(r)))
+		TokenForPath(r, "/other")
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName)
+	h.ClearAfterUsage(true)
+
+	// Render the form
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+	token := w.Body.String()
+
+	// Post the form
+	form := url.Values{}
+	form.Set(TokenName, token)
+	req := fakePost(form)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	// Load the session from the last cookie sent
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("The session should have been saved")
+	}
+	r := fakeGet()
+	r.AddCookie(cookies[len(cookies)-1])
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	if v, ok := sess.Values[TokenName]; ok {
+		t.Errorf("Tokens should be cleared, got %v", v)
+	}
+}
+
+func TestTokenWriterFlush(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		TokenFromRequest(r)
+		w.(http.Flusher).Flush()
+	}), store, cookieName)
+
+	// Run the page
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+
+	if !w.Flushed || len(w.Result().Cookies()) != 1 {
+		t.Errorf("The session should have been saved before flushing, got %v", w.Result().Cookies())
+	}
+}
+
+// hijackRecorder is a ResponseRecorder that supports hijacking
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestTokenWriterHijack(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	for _, inject := range []bool{false, true} {
+		// Hijack the connection if it's supported
+		var supported bool
+		page := func(w http.ResponseWriter, r *http.Request) {
+			var hj http.Hijacker
+			hj, supported = w.(http.Hijacker)
+			if supported {
+				hj.Hijack()
+			}
+		}
+
+		// Create the handler
+		h := New(http.HandlerFunc(page), store, cookieName)
+		h.InjectTokens(inject)
+
+		// A ResponseWriter without hijacking
+		h.ServeHTTP(httptest.NewRecorder(), fakeGet())
+		if supported {
+			t.Errorf("Inject %v: hijacking should not be supported", inject)
+		}
+
+		// A ResponseWriter with hijacking
+		w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(w, fakeGet())
+		if !supported || !w.hijacked {
+			t.Errorf("Inject %v: the connection should be hijacked", inject)
+		}
+	}
+}
+
+func TestTokenWriterExempt(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Check the response while the page is running
+	w := httptest.NewRecorder()
+	var sent bool
+	page := func(rw http.ResponseWriter, r *http.Request) {
+		TokenFromRequest(r)
+		rw.WriteHeader(http.StatusAccepted)
+		rw.Write([]byte("static"))
+		sent = w.Code == http.StatusAccepted && w.Body.String() == "static"
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName)
+	h.ExcludeRegexPaths([]string{"/static(.*)"})
+
+	// Run the page
+	req, err := http.NewRequest("GET", "http://localhost/static/app.css", nil)
+	if err != nil {
+		panic(err)
+	}
+	h.ServeHTTP(w, req)
+
+	if !sent {
+		t.Errorf("The response on an exempt path should not be held back")
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Errorf("The session should have been saved, got %v", w.Result().Cookies())
+	}
+}
+
+// readFromRecorder is a ResponseRecorder that supports io.ReaderFrom
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (w *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestTokenWriterInterfaces(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	for _, inject := range []bool{false, true} {
+		// Serve a file like http.FileServer does
+		var pushErr error
+		var unwrapped http.ResponseWriter
+		page := func(w http.ResponseWriter, r *http.Request) {
+			pushErr = w.(http.Pusher).Push("/app.css", nil)
+			unwrapped = w.(interface{ Unwrap() http.ResponseWriter }).Unwrap()
+			TokenFromRequest(r)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.CopyN(w, strings.NewReader("file"), 4)
+		}
+
+		// Create the handler
+		h := New(http.HandlerFunc(page), store, cookieName)
+		h.InjectTokens(inject)
+
+		// Run the page
+		w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(w, fakeGet())
+
+		if !w.readFrom || w.Body.String() != "file" {
+			t.Errorf("Inject %v: the body should be copied with ReadFrom, got %q", inject, w.Body.String())
+		}
+		if len(w.Result().Cookies()) != 1 {
+			t.Errorf("Inject %v: the session should have been saved, got %v", inject, w.Result().Cookies())
+		}
+		if pushErr != http.ErrNotSupported {
+			t.Errorf("Inject %v: push should not be supported, got %v", inject, pushErr)
+		}
+		if unwrapped == nil {
+			t.Errorf("Inject %v: the ResponseWriter should be unwrapped", inject)
+		}
+	}
+}
+
+func TestTokenFromRequestDuringWrite(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	tests := []struct {
+		before int
+		path   string
+	}{
+		{10, "/form1"},
+		{bufferLimit + 1, "/"},
+	}
+
+	for _, tt := range tests {
+		// Create the token after the body has started
+		var token string
+		page := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(strings.Repeat("a", tt.before)))
+			token = TokenForPath(r, tt.path)
+			w.Write([]byte(token))
+		}
+
+		// Create the handler
+		h := New(http.HandlerFunc(page), store, cookieName)
+		h.FailureHandler(http.HandlerFunc(failureHandler500))
+
+		// Run the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, fakeGet())
+
+		if !strings.HasSuffix(w.Body.String(), token) || w.Body.Len() != tt.before+len(token) {
+			t.Errorf("Write %v: the whole body should be sent, got %v bytes", tt.before, w.Body.Len())
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Write %v: the session should have been saved, got %v", tt.before, cookies)
+		}
+
+		// Submit the form
+		form := url.Values{}
+		form.Set(TokenName, token)
+		req, err := http.NewRequest("POST", "http://localhost"+tt.path, strings.NewReader(form.Encode()))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookies[0])
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Errorf("Write %v: the token should be in the saved session, got %v", tt.before, w.Code)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cookieMode stores the token in a dedicated signed cookie instead of the
+// session (signed double-submit cookie)
+type cookieMode struct {
+	name string
+	keys *keyRing
+	bind func(r *http.Request) string
+}
+
+// DoubleSubmitCookie stores the token in a dedicated cookie signed with key
+// instead of the session, so no server-side session is needed. The session
+// store passed to New can be nil and the session passed to Token,
+// TokenWithPath, and Clear is ignored. There is one token per client, so
+// TokenWithPath returns the same token as Token. The key replaces the
+// signing keys with a single key with the ID "0"; it can be nil if
+// SigningKeys is used instead.
+//
+// The cookie isn't bound to the client. Anyone who can set a cookie for the
+// domain, like a sibling subdomain or a man in the middle on plain http, can
+// plant a cookie with a token of their own. Use CookieBinding to prevent it.
+func (h *CSRFHandler) DoubleSubmitCookie(name string, key []byte) {
+	if name == "" {
+		panic("csrfbanana: double submit cookie needs a name")
+	}
+	if key != nil {
+		h.keys.set([]Key{{ID: "0", Secret: key}})
+	}
+	h.cookie = &cookieMode{name: name, keys: h.keys, bind: h.cookieBind}
+}
+
+// CookieBinding binds the DoubleSubmitCookie to a value of the client, like
+// the session ID or user ID of the application. The value is signed with the
+// token, so a cookie issued for another value is rejected with ErrBadCookie
+// and a new token is issued when the value changes.
+func (h *CSRFHandler) CookieBinding(fn func(r *http.Request) string) {
+	h.cookieBind = fn
+	if h.cookie != nil {
+		h.cookie.bind = fn
+	}
+}
+
+// purpose returns what the cookie is signed for, which includes the value it
+// is bound to
+func (c *cookieMode) purpose(r *http.Request) string {
+	if c.bind == nil {
+		return "cookie"
+	}
+	return "cookie:" + c.bind(r)
+}
+
+// read returns the token stored in the cookie if the signature is valid.
+// current is false if the cookie was signed by an older key.
+func (c *cookieMode) read(r *http.Request) (entry TokenEntry, current bool, ok bool) {
+	cookie, err := r.Cookie(c.name)
+	if err != nil {
+		return TokenEntry{}, false, false
+	}
+
+	payload, current, ok := c.keys.verify(c.purpose(r), cookie.Value)
+	if !ok {
+		return TokenEntry{}, false, false
+	}
+
+	// The payload is the token and the issue time
+	parts := strings.SplitN(payload, "|", 2)
+	if len(parts) != 2 {
+		return TokenEntry{}, false, false
+	}
+	issued, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return TokenEntry{}, false, false
+	}
+
+	return TokenEntry{Value: parts[0], Issued: time.Unix(issued, 0)}, current, true
+}
+
+// write sets the cookie on the response. The cookie is also added to the
+// request so the token isn't generated again during the same request.
+func (c *cookieMode) write(w http.ResponseWriter, r *http.Request, entry TokenEntry, secure bool, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     c.name,
+		Value:    c.keys.sign(c.purpose(r), entry.Value+"|"+strconv.FormatInt(entry.Issued.Unix(), 10)),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge > 0 {
+		cookie.MaxAge = int(maxAge.Seconds())
+	}
+
+	http.SetCookie(w, cookie)
+	setRequestCookie(r, cookie.Name, cookie.Value)
+}
+
+// remove deletes the cookie from the response and the request
+func (c *cookieMode) remove(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   c.name,
+		Path:   "/",
+		MaxAge: -1,
+	})
+	setRequestCookie(r, c.name, "")
+}
+
+// setRequestCookie replaces the cookie with the same name in the request
+// header. An empty value only removes it.
+func setRequestCookie(r *http.Request, name, value string) {
+	var keep []string
+	for _, c := range r.Cookies() {
+		if c.Name != name {
+			keep = append(keep, (&http.Cookie{Name: c.Name, Value: c.Value}).String())
+		}
+	}
+	if value != "" {
+		keep = append(keep, (&http.Cookie{Name: name, Value: value}).String())
+	}
+
+	r.Header.Del("Cookie")
+	if len(keep) > 0 {
+		r.Header.Set("Cookie", strings.Join(keep, "; "))
+	}
+}
+
+// cookieEntry returns the token stored in the cookie, generating one if
+// needed. A cookie signed by an older key is signed again with the primary key.
+func (h *CSRFHandler) cookieEntry(w http.ResponseWriter, r *http.Request, o Options) TokenEntry {
+	entry, current, ok := h.cookie.read(r)
+	if !ok || entry.expired(o) {
+		entry = TokenEntry{
+			Value:  generate(o.TokenLength),
+			Issued: now(),
+		}
+	} else if current {
+		return entry
+	}
+
+	h.cookie.write(w, r, entry, h.requestOrigin(r).Scheme == "https", o.MaxAge)
+	return entry
+}
+
+// cookieToken returns the token stored in the cookie, generating one if needed
+func (h *CSRFHandler) cookieToken(w http.ResponseWriter, r *http.Request, o Options) string {
+	entry := h.cookieEntry(w, r, o)
+
+	if o.Masked {
+		return maskToken(entry.Value)
+	}
+	return entry.Value
+}
+
+// matchCookie returns nil if the sent token matches the token in the cookie
+func (h *CSRFHandler) matchCookie(w http.ResponseWriter, r *http.Request, o Options) error {
+	sentToken, err := readToken(r, o)
+	if err != nil {
+		return err
+	}
+
+	entry, _, ok := h.cookie.read(r)
+
+	if h.regenerateAfterUsage && ok {
+		defer h.cookie.remove(w, r)
+	}
+
+	if sentToken == "" {
+		return ErrMissingToken
+	}
+	if !ok {
+		return ErrBadCookie
+	}
+	return checkEntry(sentToken, entry, o)
+}
@@ -0,0 +1,208 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDoubleSubmitCookie(t *testing.T) {
+	// Save the reason passed to the failure handler
+	var reason error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		failureHandler500(w, r)
+	}
+
+	// Create the handler without a session store
+	h := New(http.HandlerFunc(successHandler), nil, "")
+	h.DoubleSubmitCookie("csrf", []byte("secret-key"))
+	h.FailureHandler(http.HandlerFunc(failure))
+
+	// Render the form
+	w := httptest.NewRecorder()
+	get := fakeGet()
+	token := h.Token(w, get, nil)
+
+	// The token is the same for the rest of the request
+	if token2 := h.TokenWithPath(w, get, nil, "/other"); token != token2 {
+		t.Errorf("Tokens should match: expected %v, got %v", token, token2)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf" || !cookies[0].HttpOnly {
+		t.Fatalf("Wrong cookie set: %v", cookies)
+	}
+	cookie := cookies[0]
+
+	// A tampered cookie
+	tampered := *cookie
+	tampered.Value = generate(TokenLength) + tampered.Value[TokenLength:]
+
+	// A cookie signed with another key
+	other := New(http.HandlerFunc(successHandler), nil, "")
+	other.DoubleSubmitCookie("csrf", []byte("other-key"))
+	ow := httptest.NewRecorder()
+	otherToken := other.Token(ow, fakeGet(), nil)
+	otherCookie := ow.Result().Cookies()[0]
+
+	tests := []struct {
+		token  string
+		cookie *http.Cookie
+		err    error
+	}{
+		{token, cookie, nil},
+		{"", cookie, ErrMissingToken},
+		{generate(TokenLength), cookie, ErrBadToken},
+		{token, nil, ErrBadCookie},
+		{token, &tampered, ErrBadCookie},
+		{otherToken, otherCookie, ErrBadCookie},
+	}
+
+	for _, tt := range tests {
+		reason = nil
+
+		// Create the POST request
+		form := url.Values{}
+		form.Set(TokenName, tt.token)
+		req := fakePost(form)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+
+		// Run the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if reason != tt.err {
+			t.Errorf("Token %q with cookie %v: expected reason %v, got %v", tt.token, tt.cookie, tt.err, reason)
+		}
+	}
+}
+
+func TestDoubleSubmitCookieClearAfterUsage(t *testing.T) {
+	// Create the handler without a session store
+	h := New(http.HandlerFunc(successHandler), nil, "")
+	h.DoubleSubmitCookie("csrf", []byte("secret-key"))
+	h.ClearAfterUsage(true)
+
+	// Render the form
+	w := httptest.NewRecorder()
+	token := h.Token(w, fakeGet(), nil)
+	cookie := w.Result().Cookies()[0]
+
+	// Create the POST request
+	form := url.Values{}
+	form.Set(TokenName, token)
+	req := fakePost(form)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+
+	// Run the page, the token handler issues a new token
+	w = httptest.NewRecorder()
+	var token2 string
+	h.nextHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token2 = h.Token(w, r, nil)
+		successHandler(w, r)
+	})
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("The request should have succeeded, but it didn't. Instead, the code was %d",
+			w.Code)
+	}
+	if token2 == "" || token2 == token {
+		t.Errorf("A new token should have been issued, got %v", token2)
+	}
+	if !strings.Contains(strings.Join(w.Header()["Set-Cookie"], "\n"), "csrf=") {
+		t.Errorf("A new cookie should have been set, got %v", w.Header()["Set-Cookie"])
+	}
+}
+
+func TestDoubleSubmitCookieClear(t *testing.T) {
+	// Create the handler without a session store
+	h := New(http.HandlerFunc(successHandler), nil, "")
+	h.DoubleSubmitCookie("csrf", []byte("secret-key"))
+
+	// Render the form
+	w := httptest.NewRecorder()
+	h.Token(w, fakeGet(), nil)
+
+	// Clear the token
+	req := fakeGet()
+	req.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	h.Clear(w, req, nil)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("The cookie should have been deleted, got %v", cookies)
+	}
+	if _, err := req.Cookie("csrf"); err == nil {
+		t.Error("The cookie should have been removed from the request")
+	}
+}
+
+func TestDoubleSubmitCookieBinding(t *testing.T) {
+	// Save the reason passed to the failure handler
+	var reason error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		failureHandler500(w, r)
+	}
+
+	// Bind the cookie to the user in another cookie
+	h := New(http.HandlerFunc(successHandler), nil, "")
+	h.CookieBinding(func(r *http.Request) string {
+		c, err := r.Cookie("user")
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	})
+	h.DoubleSubmitCookie("csrf", []byte("secret-key"))
+	h.FailureHandler(http.HandlerFunc(failure))
+
+	// render returns the token and cookie for the user
+	render := func(user string) (string, *http.Cookie) {
+		w := httptest.NewRecorder()
+		get := fakeGet()
+		get.AddCookie(&http.Cookie{Name: "user", Value: user})
+		token := h.Token(w, get, nil)
+		return token, w.Result().Cookies()[0]
+	}
+	token, cookie := render("victim")
+	attackerToken, attackerCookie := render("attacker")
+
+	tests := []struct {
+		token  string
+		cookie *http.Cookie
+		err    error
+	}{
+		{token, cookie, nil},
+		// A cookie planted by the attacker with a token of their own
+		{attackerToken, attackerCookie, ErrBadCookie},
+	}
+
+	for _, tt := range tests {
+		reason = nil
+
+		// Create the POST request from the victim
+		form := url.Values{}
+		form.Set(TokenName, tt.token)
+		req := fakePost(form)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "user", Value: "victim"})
+		req.AddCookie(tt.cookie)
+
+		// Run the page
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if reason != tt.err {
+			t.Errorf("Token %v: expected %v, got %v", tt.token, tt.err, reason)
+		}
+	}
+}
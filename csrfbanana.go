@@ -8,9 +8,12 @@ package csrfbanana
 // <input type="hidden" name="token" value="{{.token}}">
 
 import (
+	"context"
 	"encoding/gob"
+	"net"
 	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/gorilla/sessions"
 )
@@ -20,32 +23,238 @@ type CSRFHandler struct {
 	failureHandler       http.Handler
 	perRequest           int
 	regenerateAfterUsage bool
+	injectTokens         bool
+	queryTokenHook       func(r *http.Request)
+	grace                bool
+	graceDuration        time.Duration
+	graceUses            int
 	excludeRegexPaths    []*regexp.Regexp
-	store                sessions.Store
-	sessionName          string
+	trustedOrigins       []originPattern
+	trustedProxies       []*net.IPNet
+	tokens               TokenStore
+	customStore          bool
+	storeErrorPolicy     StoreErrorPolicy
+	cookie               *cookieMode
+	cookieBind           func(r *http.Request) string
+	derived              *derivedMode
+	keys                 *keyRing
 	nextHandler          http.Handler
+	opts                 *Options
 }
 
-// StringMap has key of string and value of string
+// Options contains the token settings for a single CSRFHandler. A zero
+// TokenLength, TokenName, MaxTokens, or HeaderName falls back to the matching
+// package-level variable when the handler is created.
+type Options struct {
+	TokenLength int    // Length of the token
+	TokenName   string // Name of the token in the forms and session
+	SingleToken bool   // True is one token for entire session, false is unique token for each URL
+	MaxTokens   int    // Maximum number of tokens saved in a session
+	HeaderName  string // Name of the request header checked before the body
+	Masked      bool   // True masks the token with a one-time pad on every render (prevents BREACH)
+
+	// Strict only reads the token from the header, the POST form, or the
+	// body, never the URL query string where it ends up in logs and Referer
+	// headers
+	Strict bool
+
+	// MultipartMaxBytes is how much of a multipart/form-data body is read to
+	// find the token, 64KB if zero. The token must come before any file in
+	// the form.
+	MultipartMaxBytes int64
+
+	// MaxBodyBytes limits how much of the request body is read to find the
+	// token. A request with a larger body fails with ErrBodyTooLarge. The
+	// limit only applies while the token is found, so the next handler can
+	// still read a longer body, like a file after the token in a multipart
+	// form. Zero is no limit.
+	MaxBodyBytes int64
+
+	// JSONPointer is the location of the token in a JSON body, like
+	// /meta/csrf. Empty is the TokenName at the top of the object.
+	JSONPointer string
+
+	// MaxAge is how long a token is valid after it is issued. Once it passes,
+	// the token is rejected and Token() issues a new one. Zero never expires.
+	MaxAge time.Duration
+}
+
+// StringMap has key of string and value of string. It is the format used by
+// older versions to store tokens and is only read so those sessions still work.
 type StringMap map[string]string
 
+// TokenEntry is a token and the time it was issued
+type TokenEntry struct {
+	Value  string
+	Issued time.Time
+
+	// The token replaced by ClearAfterUsage, when it was used, and how many
+	// times it was accepted again during the GracePeriod
+	Previous     string
+	Rotated      time.Time
+	PreviousUses int
+}
+
+// TokenMap has key of URL path and value of TokenEntry
+type TokenMap map[string]TokenEntry
+
+// NonceMap has key of URL path and value of the unused single-use tokens for
+// that path, oldest first. It is used by PerRequest.
+type NonceMap map[string][]TokenEntry
+
 func init() {
 	// Magic goes here to allow serializing maps in securecookie
 	// http://golang.org/pkg/encoding/gob/#Register
 	// Source: http://stackoverflow.com/questions/21934730/gob-type-not-registered-for-interface-mapstringinterface
 	gob.Register(StringMap{})
+	gob.Register(TokenMap{})
+	gob.Register(NonceMap{})
+	gob.Register(derivedSecret(""))
 }
 
-// New can be used as middleware because it returns an http.HandlerFunc
-func New(next http.Handler, sessStore sessions.Store, sessName string) *CSRFHandler {
+// New can be used as middleware because it returns an http.HandlerFunc.
+// If Options are passed, they are used instead of the package-level
+// variables so each handler can have its own settings. The session store can
+// be nil if DoubleSubmitCookie or another TokenStore is used.
+func New(next http.Handler, sessStore sessions.Store, sessName string, opts ...Options) *CSRFHandler {
 	cs := &CSRFHandler{}
 	cs.nextHandler = next
 	cs.failureHandler = http.HandlerFunc(defaultFailureHandler)
-	cs.store = sessStore
-	cs.sessionName = sessName
+	if sessStore != nil {
+		cs.tokens = NewSessionTokenStore(sessStore, sessName)
+	}
+	cs.keys = &keyRing{}
+	if len(opts) > 0 {
+		if !validPointer(opts[0].JSONPointer) {
+			panic("csrfbanana: invalid JSON pointer " + opts[0].JSONPointer)
+		}
+		o := opts[0].withDefaults()
+		cs.opts = &o
+	}
 	return cs
 }
 
+// DefaultOptions returns the Options built from the package-level variables
+func DefaultOptions() Options {
+	return Options{
+		TokenLength: TokenLength,
+		TokenName:   TokenName,
+		SingleToken: SingleToken,
+		MaxTokens:   MaxTokens,
+		HeaderName:  TokenHeader,
+
+		MultipartMaxBytes: defaultMultipartMaxBytes,
+	}
+}
+
+// withDefaults fills the empty fields from the package-level variables
+func (o Options) withDefaults() Options {
+	if o.TokenLength <= 0 {
+		o.TokenLength = TokenLength
+	}
+	if o.TokenName == "" {
+		o.TokenName = TokenName
+	}
+	if o.MaxTokens <= 0 {
+		o.MaxTokens = MaxTokens
+	}
+	if o.HeaderName == "" {
+		o.HeaderName = TokenHeader
+	}
+	if o.MultipartMaxBytes <= 0 {
+		o.MultipartMaxBytes = defaultMultipartMaxBytes
+	}
+	return o
+}
+
+// Options returns the settings used by the handler. Handlers created without
+// Options read the package-level variables on every call.
+func (h *CSRFHandler) Options() Options {
+	if h.opts != nil {
+		return *h.opts
+	}
+	return DefaultOptions()
+}
+
+// Token will return a token using the handler settings
+func (h *CSRFHandler) Token(w http.ResponseWriter, r *http.Request, sess *sessions.Session) string {
+	t, _ := h.TokenE(w, r, sess)
+	return t
+}
+
+// TokenE is like Token, but returns the error from saving the session
+func (h *CSRFHandler) TokenE(w http.ResponseWriter, r *http.Request, sess *sessions.Session) (string, error) {
+	return h.TokenWithPathE(w, r, sess, tokenPath(r, h.Options()))
+}
+
+// TokenWithPath will return a token for the specified URL using the handler
+// settings. If the session is nil or Store was called, the token is stored in
+// the TokenStore instead of the session.
+func (h *CSRFHandler) TokenWithPath(w http.ResponseWriter, r *http.Request, sess *sessions.Session, urlPath string) string {
+	t, _ := h.TokenWithPathE(w, r, sess, urlPath)
+	return t
+}
+
+// TokenWithPathE is like TokenWithPath, but returns the error from saving the session
+func (h *CSRFHandler) TokenWithPathE(w http.ResponseWriter, r *http.Request, sess *sessions.Session, urlPath string) (string, error) {
+	if h.cookie == nil && h.usesStore(sess) {
+		return h.storeToken(w, r, urlPath)
+	}
+
+	t, changed := h.issue(w, r, sess, urlPath, h.Options())
+	if changed {
+		return t, sess.Save(r, w)
+	}
+	return t, nil
+}
+
+// issue returns the token for urlPath from the cookie or session. changed is
+// true if the session must be saved.
+func (h *CSRFHandler) issue(w http.ResponseWriter, r *http.Request, sess *sessions.Session, urlPath string, o Options) (string, bool) {
+	switch {
+	case h.derived != nil:
+		return h.derivedToken(w, r, sess, urlPath, o)
+	case h.cookie != nil:
+		return h.cookieToken(w, r, o), false
+	case h.perRequest > 0:
+		return issueNonce(sess, urlPath, o, h.perRequest)
+	}
+	return issueToken(sess, urlPath, o)
+}
+
+// Clear will remove all the tokens using the handler settings. If the
+// session is nil or Store was called, the tokens are removed from the
+// TokenStore, like ClearFromRequest.
+func (h *CSRFHandler) Clear(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
+	h.ClearE(w, r, sess)
+}
+
+// ClearE is like Clear, but returns the error from saving the session
+func (h *CSRFHandler) ClearE(w http.ResponseWriter, r *http.Request, sess *sessions.Session) error {
+	if h.cookie != nil || h.usesStore(sess) {
+		return h.ClearFromRequest(w, r)
+	}
+	h.forgetTokens(r)
+	return clearTokens(w, r, sess, h.Options())
+}
+
+// StoreErrorPolicy decides what ServeHTTP does when the session can't be
+// loaded from the store, like when the cookie was tampered with
+type StoreErrorPolicy int
+
+const (
+	// FailClosed serves the FailureHandler with ErrSessionUnavailable
+	FailClosed StoreErrorPolicy = iota
+	// NewSession replaces the broken session with a new, empty one. The new
+	// session has no tokens so the request is still checked and fails.
+	NewSession
+)
+
+// OnStoreError sets what happens when the session can't be loaded (default is FailClosed)
+func (h *CSRFHandler) OnStoreError(p StoreErrorPolicy) {
+	h.storeErrorPolicy = p
+}
+
 // RegenerateEveryRequest will regenerate a token everytime it's checked (prevents double submit problem)
 func (h *CSRFHandler) ClearAfterUsage(bl bool) {
 	h.regenerateAfterUsage = bl
@@ -66,57 +275,145 @@ func (h *CSRFHandler) FailureHandler(handler http.Handler) {
 
 // ServeHTTP will valid a token and it is does not match, it will show the FailureHandler
 func (h *CSRFHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !h.isExempt(r.URL.Path) {
-
-		// *********************************************************************
-		// Source: https://github.com/justinas/nosurf/blob/master/handler.go
-		// MIT License in nosurf.go
-		//
-		// if the request is secure, we enforce origin check
-		// for referer to prevent MITM of http->https requests
-		if r.URL.Scheme == "https" {
-			referer, err := r.URL.Parse(r.Header.Get("Referer"))
-
-			// if we can't parse the referer or it's empty,
-			// we assume it's not specified
-			if err != nil || referer.String() == "" {
-				h.failureHandler.ServeHTTP(w, r)
-				return
-			}
-
-			// if the referer doesn't share origin with the request URL,
-			// we have another error for that
-			if !sameOrigin(referer, r.URL) {
-				h.failureHandler.ServeHTTP(w, r)
-				return
-			}
-		}
-		// *********************************************************************
+	// Make the tokens available with TokenFromRequest and save the session
+	// before the response is written. The request is updated in place, like
+	// gorilla/sessions does, so the caller sees the same request.
+	rt := &requestTokens{h: h, w: w, r: r}
+	*r = *r.WithContext(context.WithValue(r.Context(), requestTokensKey, rt))
 
-		// Get the session
-		sess, _ := h.store.Get(r, h.sessionName)
+	// Exempt paths, like static files, aren't held back. Tokens created
+	// there are saved right away.
+	exempt := h.isExempt(r.URL.Path)
+	if exempt {
+		rt.written = true
+	} else {
+		tw := &tokenWriter{ResponseWriter: w, rt: rt}
+		w = tw.responseWriter()
+		defer tw.finish()
+	}
 
-		isMatch := true
+	// If method is POST, PUT, or DELETE
+	if !exempt && !sContains(safeMethods, r.Method) {
 
-		// If method is POST, PUT, or DELETE
-		if !sContains(safeMethods, r.Method) {
-			// Determine if the token matches
-			isMatch = match(r, sess, h.regenerateAfterUsage)
+		// Determine if the request came from a trusted origin
+		if err := h.checkOrigin(r); err != nil {
+			h.fail(w, r, err)
+			return
 		}
 
-		// If the token does NOT match
-		if !isMatch {
-			// Serve the Failure Handler
-			h.failureHandler.ServeHTTP(w, r)
+		// Determine if the token matches
+		if err := h.checkQuery(r, h.checkBody(w, r)); err != nil {
+			h.fail(w, r, err)
 			return
 		}
+		h.setStatus(r, StatusValid)
+	}
 
+	// Add the tokens to the forms in the response
+	if h.injectTokens && r.Method != "HEAD" {
+		iw := newInjectWriter(w, r, rt)
+		defer iw.finish()
+		w = iw.responseWriter()
 	}
 
 	// Serve the next handler
 	h.nextHandler.ServeHTTP(w, r)
 }
 
+// check returns nil if the token sent with the request is valid
+func (h *CSRFHandler) check(w http.ResponseWriter, r *http.Request) error {
+	// Check a token derived from the secret in the cookie or session
+	if h.derived != nil {
+		return h.matchDerived(w, r, h.Options())
+	}
+
+	// Check the token against the signed cookie instead of the session
+	if h.cookie != nil {
+		return h.matchCookie(w, r, h.Options())
+	}
+
+	// Use up the nonce while no other request can
+	if store, ok := h.tokens.(AtomicTokenStore); ok && h.perRequest > 0 {
+		return h.useNonce(w, r, store, h.Options())
+	}
+
+	// Get the session
+	sess, err := h.session(w, r)
+	if err != nil {
+		return err
+	}
+
+	// The nonce is used up, so the session always changes
+	if h.perRequest > 0 {
+		h.markDirty(r)
+		return matchNonce(r, sess, h.Options(), h.regenerateAfterUsage)
+	}
+
+	// The used token is replaced in the session, or the tokens are converted
+	// from an older format and keep their issue time
+	if h.regenerateAfterUsage || isLegacy(sess, h.Options()) {
+		h.markDirty(r)
+	}
+
+	// Keep the used token for the grace period
+	if h.regenerateAfterUsage && h.grace {
+		return h.matchGrace(r, sess, h.Options())
+	}
+
+	return match(r, sess, h.Options(), h.regenerateAfterUsage)
+}
+
+// session returns the session for the request. Inside ServeHTTP, the session
+// is only loaded once and saved at the end of the request.
+func (h *CSRFHandler) session(w http.ResponseWriter, r *http.Request) (*sessions.Session, error) {
+	if rt := requestTokensFrom(r); rt != nil && rt.h == h {
+		return rt.session()
+	}
+	return h.loadSession(w, r)
+}
+
+// markDirty saves the session at the end of the request when called inside
+// ServeHTTP
+func (h *CSRFHandler) markDirty(r *http.Request) {
+	if rt := requestTokensFrom(r); rt != nil && rt.h == h {
+		rt.dirty = true
+	}
+}
+
+// loadSession loads the tokens from the TokenStore into a session that only
+// has the tokens, and applies the StoreErrorPolicy if it fails
+func (h *CSRFHandler) loadSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, error) {
+	if h.tokens == nil {
+		return nil, ErrSessionUnavailable
+	}
+
+	key := h.Options().TokenName
+	value, err := h.tokens.Get(r, key)
+	if err != nil {
+		if h.storeErrorPolicy != NewSession {
+			return nil, ErrSessionUnavailable
+		}
+
+		// Replace the broken value with nothing
+		if err := h.tokens.Clear(w, r); err != nil {
+			return nil, ErrSessionUnavailable
+		}
+		value = nil
+	}
+
+	sess := sessions.NewSession(nil, key)
+	if value != nil {
+		sess.Values[key] = value
+	}
+	return sess, nil
+}
+
+// fail serves the FailureHandler with the reason stored in the request context
+func (h *CSRFHandler) fail(w http.ResponseWriter, r *http.Request, reason error) {
+	h.setStatus(r, StatusInvalid)
+	h.failureHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), failureReasonKey, reason)))
+}
+
 // Returns true if the current request is exempt
 func (h *CSRFHandler) isExempt(url string) bool {
 	for _, re := range h.excludeRegexPaths {
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"encoding/json"
 
@@ -382,7 +383,7 @@ func TestClearAfterUsage(t *testing.T) {
 	// Run the page
 	h.ServeHTTP(w, req)
 
-	if _, ok := sess.Values[TokenName].(StringMap)["/"]; ok {
+	if _, ok := sess.Values[TokenName].(TokenMap)["/"]; ok {
 		t.Error("The token should have been deleted.")
 	}
 }
@@ -425,7 +426,8 @@ func TestDontClearAfterUsage(t *testing.T) {
 	// Run the page
 	h.ServeHTTP(w, req)
 
-	if _, ok := sess.Values[TokenName].(StringMap)["/"]; !ok {
+	// The StringMap is converted and saved so the token keeps its issue time
+	if _, ok := sess.Values[TokenName].(TokenMap)["/"]; !ok {
 		t.Error("The token should not have been deleted.")
 	}
 }
@@ -563,3 +565,408 @@ func TestSameOriginBlock(t *testing.T) {
 			w.Code)
 	}
 }
+
+func TestOptionsDefaults(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler with only the token name set
+	h := New(http.HandlerFunc(successHandler), store, cookieName, Options{TokenName: "admin"})
+
+	o := h.Options()
+	if o.TokenName != "admin" {
+		t.Errorf("Wrong token name: expected %v, got %v", "admin", o.TokenName)
+	}
+	if o.TokenLength != TokenLength {
+		t.Errorf("Wrong token length: expected %v, got %v", TokenLength, o.TokenLength)
+	}
+	if o.MaxTokens != MaxTokens {
+		t.Errorf("Wrong max tokens: expected %v, got %v", MaxTokens, o.MaxTokens)
+	}
+
+	// A handler without Options follows the package-level variables
+	h2 := New(http.HandlerFunc(successHandler), store, cookieName)
+	TokenLength = 10
+	if h2.Options().TokenLength != 10 {
+		t.Errorf("Wrong token length: expected %v, got %v", 10, h2.Options().TokenLength)
+	}
+	TokenLength = 32
+}
+
+func TestOptionsPerHandler(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Create two handlers with different settings
+	public := New(http.HandlerFunc(successHandler), store, cookieName, Options{TokenName: "public", TokenLength: 16})
+	admin := New(http.HandlerFunc(successHandler), store, cookieName, Options{TokenName: "admin", TokenLength: 64, SingleToken: true})
+
+	// Create the GET request
+	req, err := http.NewRequest("GET", "http://localhost/test", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// Get the session
+	sess, err := store.Get(req, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	token1 := public.Token(w, req, sess)
+	token2 := admin.Token(w, req, sess)
+
+	if len(token1) != 16 || token1 != sess.Values["public"].(TokenMap)["/test"].Value {
+		t.Errorf("Public token is wrong: got %v, session has %v", token1, sess.Values["public"])
+	}
+	if len(token2) != 64 || token2 != sess.Values["admin"].(TokenMap)["/"].Value {
+		t.Errorf("Admin token is wrong: got %v, session has %v", token2, sess.Values["admin"])
+	}
+
+	// Post the admin token back to the admin handler
+	form := url.Values{}
+	form.Set("admin", token2)
+	req2, err := http.NewRequest("POST", "http://localhost/other", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	req2.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	sess2, err := store.Get(req2, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	sess2.Values["admin"] = sess.Values["admin"]
+
+	admin.ServeHTTP(w, req2)
+
+	if w.Code != 200 {
+		t.Errorf("The request should have succeeded, but it didn't. Instead, the code was %d",
+			w.Code)
+	}
+
+	// Clear only removes the handler's own tokens
+	admin.Clear(w, req, sess)
+	if _, ok := sess.Values["admin"]; ok {
+		t.Error("The admin tokens should have been cleared.")
+	}
+	if _, ok := sess.Values["public"]; !ok {
+		t.Error("The public tokens should not have been cleared.")
+	}
+}
+
+func TestCSRFHeader(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Create the handler
+	h := New(http.HandlerFunc(successHandler), store, cookieName)
+
+	// Create the DELETE request with no body
+	req, err := http.NewRequest("DELETE", "http://localhost/", nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set(TokenHeader, "123456")
+
+	// Get the session
+	sess, err := store.Get(req, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Set the values in the session manually
+	sess.Values[TokenName] = make(StringMap)
+	sess.Values[TokenName].(StringMap)["/"] = "123456"
+
+	// Run the page
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("The request should have succeeded, but it didn't. Instead, the code was %d",
+			w.Code)
+	}
+}
+
+func TestCSRFHeaderPrecedence(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler with a custom header name
+	h := New(http.HandlerFunc(successHandler), store, cookieName, Options{HeaderName: "X-Token"})
+
+	tests := []struct {
+		header string
+		body   string
+		code   int
+	}{
+		// Header is used even though the body is wrong
+		{"123456", "bad", 200},
+		// Header is used even though the body is right
+		{"bad", "123456", 400},
+		// Body is used when the header is missing
+		{"", "123456", 200},
+	}
+
+	for _, tt := range tests {
+		// Create the recorder
+		w := httptest.NewRecorder()
+
+		// Create the form
+		form := url.Values{}
+		form.Set(TokenName, tt.body)
+
+		// Create the POST request
+		req, err := http.NewRequest("POST", "http://localhost/", bytes.NewBufferString(form.Encode()))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Token", tt.header)
+
+		// Get the session
+		sess, err := store.Get(req, cookieName)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+
+		// Set the values in the session manually
+		sess.Values[TokenName] = make(StringMap)
+		sess.Values[TokenName].(StringMap)["/"] = "123456"
+
+		// Run the page
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("Header %q and body %q: expected code %d, got %d",
+				tt.header, tt.body, tt.code, w.Code)
+		}
+	}
+}
+
+func TestCSRFMasked(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler with masked tokens
+	h := New(http.HandlerFunc(successHandler), store, cookieName, Options{Masked: true})
+
+	// Render the page twice
+	get := fakeGet()
+	sess, err := store.Get(get, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	masked1 := h.Token(httptest.NewRecorder(), get, sess)
+	masked2 := h.Token(httptest.NewRecorder(), get, sess)
+	raw := sess.Values[TokenName].(TokenMap)["/"].Value
+
+	if masked1 == masked2 || masked1 == raw {
+		t.Errorf("Masked tokens should differ on every render: got %v and %v for %v", masked1, masked2, raw)
+	}
+
+	// Save the reason passed to the failure handler
+	var reason error
+	h.FailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		defaultFailureHandler(w, r)
+	}))
+
+	tests := []struct {
+		token  string
+		code   int
+		reason error
+	}{
+		{masked1, 200, nil},
+		{masked2, 200, nil},
+		// The stored secret must not be sent as is
+		{raw, 400, ErrBadToken},
+		// A token that can't be unmasked is bad, not missing
+		{"not*base64", 400, ErrBadToken},
+		{"", 400, ErrMissingToken},
+	}
+
+	for _, tt := range tests {
+		reason = nil
+
+		// Create the recorder
+		w := httptest.NewRecorder()
+
+		// Create the POST request
+		form := url.Values{}
+		form.Set(TokenName, tt.token)
+		req := fakePost(form)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		// Copy the tokens to the new session
+		sess2, err := store.Get(req, cookieName)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		sess2.Values[TokenName] = sess.Values[TokenName]
+
+		// Run the page
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code || reason != tt.reason {
+			t.Errorf("Token %q: expected code %d and %v, got %d and %v", tt.token, tt.code, tt.reason, w.Code, reason)
+		}
+	}
+}
+
+func TestCSRFMaskedClearAfterUsage(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	tests := []struct {
+		name  string
+		setup func(h *CSRFHandler)
+	}{
+		{"ClearAfterUsage", func(h *CSRFHandler) { h.ClearAfterUsage(true) }},
+		{"PerRequest", func(h *CSRFHandler) { h.ClearAfterUsage(true); h.PerRequest(2) }},
+		{"GracePeriod", func(h *CSRFHandler) { h.ClearAfterUsage(true); h.GracePeriod(time.Minute, 1) }},
+	}
+
+	for _, tt := range tests {
+		// Create the handler with masked tokens
+		h := New(http.HandlerFunc(successHandler), store, cookieName, Options{Masked: true})
+		tt.setup(h)
+
+		// A token from another session can be unmasked but doesn't match
+		other := fakeGet()
+		otherSess, err := store.Get(other, cookieName)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		wrong := h.Token(httptest.NewRecorder(), other, otherSess)
+
+		for _, token := range []string{wrong, "not*base64"} {
+			// Render the page
+			get := fakeGet()
+			sess, err := store.Get(get, cookieName)
+			if err != nil {
+				t.Fatalf("Error getting session: %v", err)
+			}
+			h.Token(httptest.NewRecorder(), get, sess)
+
+			// Create the POST request
+			form := url.Values{}
+			form.Set(TokenName, token)
+			req := fakePost(form)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			// Copy the tokens to the new session
+			sess2, err := store.Get(req, cookieName)
+			if err != nil {
+				t.Fatalf("Error getting session: %v", err)
+			}
+			sess2.Values[TokenName] = sess.Values[TokenName]
+
+			// Run the page
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			// The token for the page is cleared either way
+			var cleared bool
+			switch tokens := sess2.Values[TokenName].(type) {
+			case TokenMap:
+				_, ok := tokens["/"]
+				cleared = !ok
+			case NonceMap:
+				_, ok := tokens["/"]
+				cleared = !ok
+			}
+			if !cleared {
+				t.Errorf("%v, token %q: the token should be cleared, got %v", tt.name, token, sess2.Values[TokenName])
+			}
+		}
+	}
+}
+
+func TestSecureGetNoReferer(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Create the handler
+	h := New(http.HandlerFunc(successHandler), store, cookieName)
+
+	// Create the GET request without a Referer, like a bookmark
+	req, err := http.NewRequest("GET", "https://localhost/", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// Run the page
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("The request should have succeeded, but it didn't. Instead, the code was %d",
+			w.Code)
+	}
+}
+
+func TestTrustedOrigin(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Create the handler
+	h := New(http.HandlerFunc(successHandler), store, cookieName)
+	h.TrustedOrigins([]string{"https://app.example.com"})
+
+	// Create the form
+	form := url.Values{}
+	form.Set(TokenName, "123456")
+
+	// Create the POST request from the SPA to the API
+	req, err := http.NewRequest("POST", "https://api.example.com/", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://app.example.com")
+
+	// Get the session
+	sess, err := store.Get(req, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Set the values in the session manually
+	sess.Values[TokenName] = make(StringMap)
+	sess.Values[TokenName].(StringMap)["/"] = "123456"
+
+	// Run the page
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("The request should have succeeded, but it didn't. Instead, the code was %d",
+			w.Code)
+	}
+}
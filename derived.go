@@ -0,0 +1,153 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// derivedMode derives the token for each path from a single secret per
+// session instead of storing a random token for each path
+type derivedMode struct {
+	keys *keyRing
+}
+
+// DerivedTokens derives the token for each path as
+// HMAC(key, session secret || path || expiry), so only one secret is stored
+// per session and MaxTokens no longer applies. Tokens are still bound to the
+// path like TokenWithPath. The secret is stored in the session, or in the
+// cookie if DoubleSubmitCookie is used. Because the tokens aren't stored,
+// ClearAfterUsage replaces the secret, which rejects every token issued before.
+// The key replaces the signing keys with a single key with the ID "0"; it can
+// be nil if SigningKeys is used instead.
+func (h *CSRFHandler) DerivedTokens(key []byte) {
+	if key != nil {
+		h.keys.set([]Key{{ID: "0", Secret: key}})
+	}
+	h.derived = &derivedMode{keys: h.keys}
+}
+
+// derive returns "id.expiry.hmac", the token for the path that expires at
+// the Unix time. Zero never expires.
+func (d *derivedMode) derive(secret, path string, expiry int64) string {
+	key := d.keys.primary()
+	exp := strconv.FormatInt(expiry, 10)
+	return key.ID + "." + exp + "." + d.keys.mac(key, "token", secret, path, exp)
+}
+
+// check returns nil if the sent token was derived from the secret and path
+// and has not expired
+func (d *derivedMode) check(sentToken, secret, path string) error {
+	parts := strings.Split(sentToken, ".")
+	if len(parts) != 3 {
+		return ErrBadToken
+	}
+
+	key, ok := d.keys.find(parts[0])
+	if !ok {
+		return ErrBadToken
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrBadToken
+	}
+
+	if !compareTokens(parts[2], d.keys.mac(key, "token", secret, path, parts[1])) {
+		return ErrBadToken
+	}
+	if expiry != 0 && now().Unix() > expiry {
+		return ErrExpiredToken
+	}
+	return nil
+}
+
+// expiry returns when a token issued now expires
+func expiry(o Options) int64 {
+	if o.MaxAge <= 0 {
+		return 0
+	}
+	return now().Add(o.MaxAge).Unix()
+}
+
+// sessionSecret returns the secret stored in the session. If create is true,
+// a missing secret is generated and changed is true.
+func sessionSecret(sess *sessions.Session, o Options, create bool) (secret string, changed bool) {
+	if v, ok := sess.Values[o.TokenName].(derivedSecret); ok {
+		return string(v), false
+	}
+	if !create {
+		return "", false
+	}
+
+	secret = generate(o.TokenLength)
+	sess.Values[o.TokenName] = derivedSecret(secret)
+	return secret, true
+}
+
+// derivedSecret is the secret stored in the session
+type derivedSecret string
+
+// derivedToken returns the token for urlPath derived from the secret.
+// changed is true if a secret was generated and the session must be saved.
+func (h *CSRFHandler) derivedToken(w http.ResponseWriter, r *http.Request, sess *sessions.Session, urlPath string, o Options) (t string, changed bool) {
+	var secret string
+
+	if h.cookie != nil {
+		secret = h.cookieEntry(w, r, o).Value
+	} else {
+		secret, changed = sessionSecret(sess, o, true)
+	}
+
+	t = h.derived.derive(secret, urlPath, expiry(o))
+
+	if o.Masked {
+		return maskToken(t), changed
+	}
+	return t, changed
+}
+
+// matchDerived returns nil if the sent token was derived from the secret for
+// the page or the referer page
+func (h *CSRFHandler) matchDerived(w http.ResponseWriter, r *http.Request, o Options) error {
+	sentToken, err := readToken(r, o)
+	if err != nil {
+		return err
+	}
+
+	var secret string
+	if h.cookie != nil {
+		entry, _, ok := h.cookie.read(r)
+		if ok {
+			secret = entry.Value
+			if h.regenerateAfterUsage {
+				defer h.cookie.remove(w, r)
+			}
+		} else if sentToken != "" {
+			return ErrBadCookie
+		}
+	} else {
+		sess, err := h.session(w, r)
+		if err != nil {
+			return err
+		}
+		secret, _ = sessionSecret(sess, o, false)
+		if h.regenerateAfterUsage {
+			defer delete(sess.Values, o.TokenName)
+			h.markDirty(r)
+		}
+	}
+
+	if sentToken == "" {
+		return ErrMissingToken
+	}
+	if secret == "" {
+		return ErrBadToken
+	}
+
+	return checkPaths(r, tokenPath(r, o), func(p string) error {
+		return h.derived.check(sentToken, secret, p)
+	})
+}
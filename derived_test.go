@@ -0,0 +1,195 @@
+package csrfbanana
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestDerivedTokens(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Save the reason passed to the failure handler
+	var reason error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		failureHandler500(w, r)
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(successHandler), store, cookieName)
+	h.DerivedTokens([]byte("server-key"))
+	h.FailureHandler(http.HandlerFunc(failure))
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Create the request
+	r := fakeGet()
+
+	// Get the session
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Issue tokens for many paths
+	for i := 0; i < MaxTokens*2; i++ {
+		h.TokenWithPath(w, r, sess, fmt.Sprintf("/monkey%v", i))
+	}
+	token1 := h.TokenWithPath(w, r, sess, "/form1")
+
+	// Only the secret is stored
+	if _, ok := sess.Values[TokenName].(derivedSecret); !ok || len(sess.Values) != 1 {
+		t.Errorf("Only one secret should be stored in the session, got %v", sess.Values)
+	}
+
+	tests := []struct {
+		url     string
+		referer string
+		token   string
+		err     error
+	}{
+		{"http://localhost/form1", "", token1, nil},
+		{"http://localhost/form2", "", token1, ErrBadToken},
+		{"http://localhost/form2", "http://localhost/form1", token1, nil},
+		{"http://localhost/form1", "", "1" + token1[1:], ErrBadToken},
+		{"http://localhost/form1", "", "", ErrMissingToken},
+	}
+
+	for _, tt := range tests {
+		reason = nil
+
+		// Create the form
+		form := url.Values{}
+		form.Set(TokenName, tt.token)
+
+		// Create the POST request
+		req, err := http.NewRequest("POST", tt.url, bytes.NewBufferString(form.Encode()))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+
+		// Copy the secret to the new session
+		sess2, err := store.Get(req, cookieName)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		sess2.Values[TokenName] = sess.Values[TokenName]
+
+		// Run the page
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if reason != tt.err {
+			t.Errorf("URL %v, referer %q: expected reason %v, got %v", tt.url, tt.referer, tt.err, reason)
+		}
+	}
+
+	// Clear replaces the secret
+	h.Clear(w, r, sess)
+	if token2 := h.TokenWithPath(w, r, sess, "/form1"); token1 == token2 {
+		t.Error("Tokens should not match after Clear")
+	}
+}
+
+func TestDerivedTokensExpiry(t *testing.T) {
+	// Control the clock
+	current := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	d := &derivedMode{keys: &keyRing{}}
+	d.keys.set([]Key{{ID: "0", Secret: []byte("server-key")}})
+	o := Options{MaxAge: time.Hour}
+
+	token := d.derive("secret", "/form", expiry(o))
+
+	current = current.Add(59 * time.Minute)
+	if err := d.check(token, "secret", "/form"); err != nil {
+		t.Errorf("Token should still be valid, got %v", err)
+	}
+
+	current = current.Add(2 * time.Minute)
+	if err := d.check(token, "secret", "/form"); err != ErrExpiredToken {
+		t.Errorf("Wrong error: expected %v, got %v", ErrExpiredToken, err)
+	}
+
+	// The expiry is part of the HMAC
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + fmt.Sprintf("%d", current.Add(time.Hour).Unix()) + "." + parts[2]
+	if err := d.check(forged, "secret", "/form"); err != ErrBadToken {
+		t.Errorf("Wrong error for a forged expiry: expected %v, got %v", ErrBadToken, err)
+	}
+
+	// Another secret or key
+	if err := d.check(token, "other", "/form"); err != ErrBadToken {
+		t.Errorf("Wrong error for another secret: expected %v, got %v", ErrBadToken, err)
+	}
+	other := &derivedMode{keys: &keyRing{}}
+	other.keys.set([]Key{{ID: "0", Secret: []byte("other-key")}})
+	if err := other.check(token, "secret", "/form"); err != ErrBadToken {
+		t.Errorf("Wrong error for another key: expected %v, got %v", ErrBadToken, err)
+	}
+}
+
+func TestDerivedTokensCookie(t *testing.T) {
+	// Create the handler without a session store
+	h := New(http.HandlerFunc(successHandler), nil, "")
+	h.DoubleSubmitCookie("csrf", []byte("secret-key"))
+	h.DerivedTokens([]byte("server-key"))
+
+	// Render two forms
+	w := httptest.NewRecorder()
+	get := fakeGet()
+	token1 := h.TokenWithPath(w, get, nil, "/form1")
+	token2 := h.TokenWithPath(w, get, nil, "/form2")
+	cookie := w.Result().Cookies()[0]
+
+	if token1 == token2 {
+		t.Error("Tokens should be bound to the path")
+	}
+
+	tests := []struct {
+		path  string
+		token string
+		code  int
+	}{
+		{"/form1", token1, 200},
+		{"/form2", token2, 200},
+		{"/form2", token1, 400},
+	}
+
+	for _, tt := range tests {
+		// Create the POST request
+		form := url.Values{}
+		form.Set(TokenName, tt.token)
+		req, err := http.NewRequest("POST", "http://localhost"+tt.path, bytes.NewBufferString(form.Encode()))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+
+		// Run the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("Path %v: expected code %d, got %d", tt.path, tt.code, w.Code)
+		}
+	}
+}
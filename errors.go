@@ -0,0 +1,29 @@
+package csrfbanana
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Reasons a request can fail the CSRF check. The FailureHandler can get the
+// reason with FailureReason.
+var (
+	ErrNoReferer          = errors.New("csrfbanana: referer is missing from a secure request")
+	ErrBadReferer         = errors.New("csrfbanana: referer is not a trusted origin")
+	ErrBadOrigin          = errors.New("csrfbanana: origin is not trusted")
+	ErrMissingToken       = errors.New("csrfbanana: token is missing from the request")
+	ErrBadToken           = errors.New("csrfbanana: token does not match")
+	ErrExpiredToken       = errors.New("csrfbanana: token has expired")
+	ErrSessionUnavailable = errors.New("csrfbanana: session is unavailable")
+	ErrBadCookie          = errors.New("csrfbanana: token cookie is missing or not valid")
+	ErrBodyTooLarge       = errors.New("csrfbanana: request body is too large")
+	ErrQueryToken         = errors.New("csrfbanana: token is in the URL query string")
+	ErrUsedToken          = errors.New("csrfbanana: token was already used")
+)
+
+// FailureReason returns the reason the request failed the CSRF check. It
+// returns nil if the request didn't fail or wasn't checked.
+func FailureReason(r *http.Request) error {
+	err, _ := r.Context().Value(failureReasonKey).(error)
+	return err
+}
@@ -0,0 +1,240 @@
+package csrfbanana
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestFailureReason(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Save the reason passed to the failure handler
+	var reason error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		failureHandler500(w, r)
+	}
+
+	tests := []struct {
+		url     string
+		token   string
+		origin  string
+		referer string
+		err     error
+	}{
+		{"http://localhost/", "123456", "", "", nil},
+		{"http://localhost/", "", "", "", ErrMissingToken},
+		{"http://localhost/", "654321", "", "", ErrBadToken},
+		{"http://localhost/", "123456", "http://evil.com", "", ErrBadOrigin},
+		{"http://localhost/", "123456", "", "http://evil.com/", ErrBadReferer},
+		{"https://localhost/", "123456", "", "", ErrNoReferer},
+	}
+
+	for _, tt := range tests {
+		reason = nil
+
+		// Create the recorder
+		w := httptest.NewRecorder()
+
+		// Create the handler
+		h := New(http.HandlerFunc(successHandler), store, cookieName)
+		h.FailureHandler(http.HandlerFunc(failure))
+
+		// Create the form
+		form := url.Values{}
+		form.Set(TokenName, tt.token)
+
+		// Create the POST request
+		req, err := http.NewRequest("POST", tt.url, bytes.NewBufferString(form.Encode()))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+
+		// Get the session
+		sess, err := store.Get(req, cookieName)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+
+		// Set the values in the session manually
+		sess.Values[TokenName] = make(StringMap)
+		sess.Values[TokenName].(StringMap)["/"] = "123456"
+
+		// Run the page
+		h.ServeHTTP(w, req)
+
+		if reason != tt.err {
+			t.Errorf("Token %q, origin %q, referer %q: expected reason %v, got %v",
+				tt.token, tt.origin, tt.referer, tt.err, reason)
+		}
+	}
+}
+
+func TestFailureReasonUnchecked(t *testing.T) {
+	if err := FailureReason(fakeGet()); err != nil {
+		t.Errorf("Request should not have a reason, but got %v", err)
+	}
+}
+
+func TestTokenE(t *testing.T) {
+	// Create a store that can't save
+	saveErr := errors.New("disk full")
+	store := &failingStore{saveErr: saveErr}
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Create the request
+	r := fakeGet()
+
+	// Get the session
+	sess, err := store.Get(r, "test")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	if _, err := TokenE(w, r, sess); err != saveErr {
+		t.Errorf("Wrong error from TokenE: expected %v, got %v", saveErr, err)
+	}
+
+	if _, err := TokenWithPathE(w, r, sess, "/monkey"); err != saveErr {
+		t.Errorf("Wrong error from TokenWithPathE: expected %v, got %v", saveErr, err)
+	}
+
+	if err := ClearE(w, r, sess); err != saveErr {
+		t.Errorf("Wrong error from ClearE: expected %v, got %v", saveErr, err)
+	}
+
+	// Handler methods return the error too
+	h := New(http.HandlerFunc(successHandler), store, "test")
+	if _, err := h.TokenE(w, r, sess); err != saveErr {
+		t.Errorf("Wrong error from CSRFHandler.TokenE: expected %v, got %v", saveErr, err)
+	}
+
+	// The existing token is returned without saving
+	store.saveErr = nil
+	token, err := h.TokenE(w, r, sess)
+	if err != nil || token == "" {
+		t.Errorf("TokenE should have succeeded, got %q and %v", token, err)
+	}
+	saves := store.saves
+	if _, err := h.TokenE(w, r, sess); err != nil || store.saves != saves {
+		t.Errorf("TokenE should not save an existing token, got %v and %d saves", err, store.saves-saves)
+	}
+}
+
+func TestStoreErrorPolicy(t *testing.T) {
+	tests := []struct {
+		policy StoreErrorPolicy
+		getErr error
+		reason error
+		saves  int
+	}{
+		{FailClosed, errors.New("securecookie: the value is not valid"), ErrSessionUnavailable, 0},
+		{NewSession, errors.New("securecookie: the value is not valid"), ErrMissingToken, 1},
+		{FailClosed, nil, ErrMissingToken, 0},
+	}
+
+	for _, tt := range tests {
+		store := &failingStore{getErr: tt.getErr}
+
+		// Save the reason passed to the failure handler
+		var reason error
+		failure := func(w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(r)
+			failureHandler500(w, r)
+		}
+
+		// Create the handler
+		h := New(http.HandlerFunc(successHandler), store, "test")
+		h.FailureHandler(http.HandlerFunc(failure))
+		h.OnStoreError(tt.policy)
+
+		// Create the POST request without a token
+		req := fakePost(url.Values{})
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		// Run the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != 500 || reason != tt.reason {
+			t.Errorf("Policy %v with error %v: expected reason %v, got %v (code %d)",
+				tt.policy, tt.getErr, tt.reason, reason, w.Code)
+		}
+
+		if store.saves != tt.saves {
+			t.Errorf("Policy %v with error %v: expected %d saves, got %d",
+				tt.policy, tt.getErr, tt.saves, store.saves)
+		}
+	}
+
+	// The new session also fails closed if it can't be saved
+	store := &failingStore{getErr: errors.New("bad cookie"), saveErr: errors.New("disk full")}
+	var reason error
+	h := New(http.HandlerFunc(successHandler), store, "test")
+	h.FailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+	}))
+	h.OnStoreError(NewSession)
+	h.ServeHTTP(httptest.NewRecorder(), fakePost(url.Values{}))
+	if reason != ErrSessionUnavailable {
+		t.Errorf("Wrong reason: expected %v, got %v", ErrSessionUnavailable, reason)
+	}
+}
+
+func TestNewSessionTamperedCookie(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler that replaces a broken session
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(TokenFromRequest(r)))
+	}), store, cookieName)
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+	h.OnStoreError(NewSession)
+
+	// Render the form with a tampered session cookie
+	get := fakeGet()
+	get.AddCookie(&http.Cookie{Name: cookieName, Value: "tampered"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, get)
+	token := w.Body.String()
+
+	// The token is stored in the new session
+	cookies := w.Result().Cookies()
+	if token == "" || len(cookies) == 0 {
+		t.Fatalf("Token should be stored in a new session, got %q and %v", token, cookies)
+	}
+
+	// Post the form with the new session
+	form := url.Values{}
+	form.Set(TokenName, token)
+	req := fakePost(form)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookies[len(cookies)-1])
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("Token should be valid, got %v", w.Code)
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
-	"text/template"
 
 	"github.com/gorilla/sessions"
 	"github.com/josephspurrier/csrfbanana"
@@ -31,7 +31,7 @@ var templateString string = `
 	<label for="name" style="width: 120px; display: inline-block;">Enter your name:</label>
 	<input type="text" name="name" id="name">
 	<!-- This is where you add the token to every form that you POST -->
-	<input type="hidden" name="token" value="{{.token}}">
+	{{ csrfField .request }}
 	<input type="submit" value="Submit with Token" style="width: 160px;">
 </form>
 </div>
@@ -51,19 +51,16 @@ var templateString string = `
 `
 
 // Compiled template
-var templ = template.Must(template.New("t1").Parse(templateString))
+var templ = template.Must(template.New("t1").Funcs(csrfbanana.FuncMap).Parse(templateString))
 
 // Login handles GET and POST
 func routeLogin(w http.ResponseWriter, r *http.Request) {
 
-	// Get session
-	sess := Session(r, SessionName)
-
 	// Create a map for the template
-	vars := make(map[string]string)
+	vars := make(map[string]interface{})
 
-	// Store the CSRF token
-	vars["token"] = csrfbanana.Token(w, r, sess)
+	// Pass the request so csrfField can read the token from it
+	vars["request"] = r
 
 	// If a POST operation
 	if r.Method == "POST" {
@@ -82,12 +79,6 @@ func routeInvalidToken(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, `Your token <strong>expired</strong>, click <a href="javascript:void(0)" onclick="window.history.back()">here</a> to try again.`)
 }
 
-// Session returns a new session, never returns an error
-func Session(r *http.Request, name string) *sessions.Session {
-	session, _ := Store.Get(r, name)
-	return session
-}
-
 func main() {
 	// Create cookie store
 	Store = sessions.NewCookieStore([]byte("This is super screen..."))
@@ -0,0 +1,59 @@
+package csrfbanana
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// An Extractor returns the token sent in the body of a request and false if
+// the body does not have one. The body must be left so the next handler can
+// still read it.
+type Extractor func(r *http.Request, o Options) (string, bool)
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   = map[string]Extractor{
+		"application/json":    jsonToken,
+		"multipart/form-data": multipartToken,
+	}
+)
+
+// RegisterExtractor sets the Extractor for requests with the media type, like
+// "application/xml". It replaces the built-in one for "application/json" and
+// media types with a +json suffix if they are registered. It should be called
+// before the handlers start serving requests.
+func RegisterExtractor(mediaType string, fn Extractor) {
+	mediaType = strings.ToLower(mediaType)
+	if fn == nil {
+		panic("csrfbanana: nil extractor for " + mediaType)
+	}
+
+	extractorsMu.Lock()
+	extractors[mediaType] = fn
+	extractorsMu.Unlock()
+}
+
+// extractor returns the Extractor for the Content-Type of the request, or nil
+// if there isn't one
+func extractor(r *http.Request) Extractor {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+
+	if fn, ok := extractors[mediaType]; ok {
+		return fn
+	}
+
+	// Structured syntax suffix, like application/vnd.api+json
+	if strings.HasSuffix(mediaType, "+json") {
+		return extractors["application/json"]
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package csrfbanana
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestContentTypes(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler
+	h := New(http.HandlerFunc(successHandler), store, cookieName)
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+
+	// Render the form
+	w := httptest.NewRecorder()
+	get := fakeGet()
+	sess, err := store.Get(get, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	token := h.Token(w, get, sess)
+	cookie := w.Result().Cookies()[0]
+
+	form := url.Values{}
+	form.Set(TokenName, token)
+	jsonValue := `{"token": "` + token + `"}`
+
+	tests := []struct {
+		contentType string
+		body        string
+		code        int
+	}{
+		{"application/x-www-form-urlencoded", form.Encode(), 200},
+		{"application/x-www-form-urlencoded; charset=UTF-8", form.Encode(), 200},
+		{"application/json", jsonValue, 200},
+		{"application/json; charset=utf-8", jsonValue, 200},
+		{"Application/JSON", jsonValue, 200},
+		{"application/vnd.api+json", jsonValue, 200},
+		{"application/merge-patch+json", jsonValue, 200},
+		{"text/plain", jsonValue, 500},
+		{"application/json; charset", jsonValue, 500},
+	}
+
+	for _, tt := range tests {
+		// Create the POST request
+		req, err := http.NewRequest("POST", "http://localhost/", bytes.NewBufferString(tt.body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+		req.AddCookie(cookie)
+
+		// Run the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("Content type %v: expected code %v, got %v", tt.contentType, tt.code, w.Code)
+		}
+	}
+}
+
+func TestRegisterExtractor(t *testing.T) {
+	var cookieName = "test"
+
+	// Read the token from an XML body
+	RegisterExtractor("application/xml", func(r *http.Request, o Options) (string, bool) {
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+		v := struct {
+			Token string `xml:"token"`
+		}{}
+		if err := xml.Unmarshal(b, &v); err != nil || v.Token == "" {
+			return "", false
+		}
+		return v.Token, true
+	})
+	defer func() {
+		extractorsMu.Lock()
+		delete(extractors, "application/xml")
+		extractorsMu.Unlock()
+	}()
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler
+	h := New(http.HandlerFunc(successHandler), store, cookieName)
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+
+	// Render the form
+	w := httptest.NewRecorder()
+	get := fakeGet()
+	sess, err := store.Get(get, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	token := h.Token(w, get, sess)
+
+	// Create the POST request
+	req, err := http.NewRequest("POST", "http://localhost/", bytes.NewBufferString(`<item><token>`+token+`</token></item>`))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.AddCookie(w.Result().Cookies()[0])
+
+	// Run the page
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("The request should have succeeded, but it didn't. Instead, the code was %d", w.Code)
+	}
+}
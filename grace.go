@@ -0,0 +1,147 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// Status is the result of checking the token of a request
+type Status int
+
+const (
+	// StatusUnchecked is the status of a request that wasn't checked
+	StatusUnchecked Status = iota
+
+	// StatusValid is the status of a request with a valid token
+	StatusValid
+
+	// StatusResubmitted is the status of a request with a token that was
+	// already used, but was accepted during the grace period. The form was
+	// probably submitted twice.
+	StatusResubmitted
+
+	// StatusUsed is the status of a request with a token that was already
+	// used after the grace period. The request fails with ErrUsedToken.
+	StatusUsed
+
+	// StatusInvalid is the status of a request that failed for any other reason
+	StatusInvalid
+)
+
+// GracePeriod keeps accepting the previous token for a page after
+// ClearAfterUsage replaces it, so a double click or a browser retry doesn't
+// fail. The previous token is accepted for d after it was used and at most
+// uses more times. A zero d or uses doesn't limit that. For example,
+// GracePeriod(0, 1) accepts one extra use at any time. The request is passed
+// to the next handler, where TokenStatus returns StatusResubmitted, so it can
+// show the result of the first submission instead of repeating it. After the grace
+// period, the request fails with ErrUsedToken. It only applies to tokens
+// stored in the session.
+func (h *CSRFHandler) GracePeriod(d time.Duration, uses int) {
+	h.graceDuration = d
+	h.graceUses = uses
+	h.grace = d > 0 || uses > 0
+}
+
+// TokenStatus returns the result of checking the token of the request. It
+// can be called by the next handler or the FailureHandler.
+func TokenStatus(r *http.Request) Status {
+	if rt := requestTokensFrom(r); rt != nil {
+		return rt.status
+	}
+	return StatusUnchecked
+}
+
+// setStatus saves the result of checking the token for TokenStatus. A
+// status that was already set while checking the token is kept.
+func (h *CSRFHandler) setStatus(r *http.Request, status Status) {
+	if rt := requestTokensFrom(r); rt != nil && rt.h == h && rt.status == StatusUnchecked {
+		rt.status = status
+	}
+}
+
+// inGrace returns true if the previous token can be used again
+func (h *CSRFHandler) inGrace(entry TokenEntry) bool {
+	if h.graceDuration > 0 && now().Sub(entry.Rotated) > h.graceDuration {
+		return false
+	}
+	return h.graceUses <= 0 || entry.PreviousUses < h.graceUses
+}
+
+// matchGrace is like match with ClearAfterUsage, but the used token is kept
+// as the previous token of the new one for the grace period
+func (h *CSRFHandler) matchGrace(r *http.Request, sess *sessions.Session, o Options) error {
+	path := tokenPath(r, o)
+
+	// Token submitted via header or POST
+	sentToken, err := readToken(r, o)
+
+	// If tokens don't exist
+	tokens := tokenMap(sess, o, false)
+	if tokens == nil {
+		if sentToken == "" && err == nil {
+			return ErrMissingToken
+		}
+		return ErrBadToken
+	}
+
+	// A token that can't be unmasked fails like a wrong one
+	if err != nil {
+		delete(tokens, path)
+		return err
+	}
+
+	// If token is empty in the form, it is not valid
+	if sentToken == "" {
+		delete(tokens, path)
+		return ErrMissingToken
+	}
+
+	used := false
+	err = checkPaths(r, path, func(p string) error {
+		entry, ok := tokens[p]
+		if !ok {
+			return ErrBadToken
+		}
+
+		// Replace the token and keep the used one as the previous token
+		if err := checkEntry(sentToken, entry, o); err != ErrBadToken {
+			if err == nil {
+				tokens[p] = TokenEntry{
+					Value:    generate(o.TokenLength),
+					Issued:   now(),
+					Previous: entry.Value,
+					Rotated:  now(),
+				}
+			}
+			return err
+		}
+
+		// The previous token is accepted again during the grace period
+		if entry.Previous == "" || !compareTokens(sentToken, entry.Previous) {
+			return ErrBadToken
+		}
+		if !h.inGrace(entry) {
+			used = true
+			return ErrUsedToken
+		}
+		entry.PreviousUses++
+		tokens[p] = entry
+		h.setStatus(r, StatusResubmitted)
+		return nil
+	})
+
+	if err != nil && used {
+		h.setStatus(r, StatusUsed)
+		return ErrUsedToken
+	}
+
+	// A failed request clears the token, like ClearAfterUsage
+	if err != nil {
+		delete(tokens, path)
+	}
+
+	return err
+}
@@ -0,0 +1,123 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestGracePeriod(t *testing.T) {
+	var cookieName = "test"
+
+	// Control the clock
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	tests := []struct {
+		duration time.Duration
+		uses     int
+	}{
+		{time.Minute, 0},
+		{0, 1},
+		{time.Minute, 1},
+	}
+
+	for _, tt := range tests {
+		// Save the reason and status passed to the handlers
+		var reason error
+		var status Status
+		var token string
+		page := func(w http.ResponseWriter, r *http.Request) {
+			status = TokenStatus(r)
+			token = TokenFromRequest(r)
+			successHandler(w, r)
+		}
+		failure := func(w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(r)
+			status = TokenStatus(r)
+			failureHandler500(w, r)
+		}
+
+		// Create the handler
+		h := New(http.HandlerFunc(page), store, cookieName)
+		h.FailureHandler(http.HandlerFunc(failure))
+		h.ClearAfterUsage(true)
+		h.GracePeriod(tt.duration, tt.uses)
+
+		// Send the session cookie back with every request
+		var cookie *http.Cookie
+		serve := func(req *http.Request) {
+			reason = nil
+			status = StatusUnchecked
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if cookies := w.Result().Cookies(); len(cookies) > 0 {
+				cookie = cookies[0]
+			}
+		}
+		post := func(token string) {
+			form := url.Values{}
+			form.Set(TokenName, token)
+			req := fakePost(form)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(req)
+		}
+
+		// Render the form
+		serve(fakeGet())
+		if status != StatusUnchecked {
+			t.Errorf("Grace %v %v: GET should not be checked, got %v", tt.duration, tt.uses, status)
+		}
+		first := token
+
+		// Submit it
+		post(first)
+		if reason != nil || status != StatusValid {
+			t.Errorf("Grace %v %v: first submit expected %v, got %v %v", tt.duration, tt.uses, StatusValid, status, reason)
+		}
+
+		// The page has a new token
+		serve(fakeGet())
+		second := token
+		if second == first {
+			t.Errorf("Grace %v %v: token should be replaced", tt.duration, tt.uses)
+		}
+
+		// Submit the first token again during the grace period
+		current = current.Add(30 * time.Second)
+		post(first)
+		if reason != nil || status != StatusResubmitted {
+			t.Errorf("Grace %v %v: second submit expected %v, got %v %v", tt.duration, tt.uses, StatusResubmitted, status, reason)
+		}
+
+		// And again after the grace period
+		current = current.Add(time.Minute)
+		post(first)
+		if reason != ErrUsedToken || status != StatusUsed {
+			t.Errorf("Grace %v %v: third submit expected %v, got %v %v", tt.duration, tt.uses, StatusUsed, status, reason)
+		}
+
+		// The new token still works
+		post(second)
+		if reason != nil || status != StatusValid {
+			t.Errorf("Grace %v %v: new token expected %v, got %v %v", tt.duration, tt.uses, StatusValid, status, reason)
+		}
+
+		// A bad token
+		post("bad")
+		if reason != ErrBadToken || status != StatusInvalid {
+			t.Errorf("Grace %v %v: bad token expected %v, got %v %v", tt.duration, tt.uses, StatusInvalid, status, reason)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package csrfbanana
+
+import (
+	"bufio"
+	"bytes"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// InjectTokens rewrites text/html responses to add a hidden input with the
+// token to every <form method="post">. The token is for the path in the
+// action of the form, like TokenWithPath. Forms with the data-csrf-skip
+// attribute or an action on another host are left alone.
+//
+// With DerivedTokens or DoubleSubmitCookie, the response is streamed. Tokens
+// stored in the session may need to be generated while the body is written,
+// so the whole HTML response is kept in memory until the handler returns and
+// the session is saved.
+func (h *CSRFHandler) InjectTokens(bl bool) {
+	h.injectTokens = bl
+}
+
+// rawTextTags contain text that is not parsed as HTML
+var rawTextTags = []string{"script", "style", "textarea", "title"}
+
+// injectWriter adds the hidden inputs to the forms in an HTML response
+type injectWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	rt      *requestTokens
+	code    int
+	pending bool
+	decided bool
+	active  bool
+	buffer  bool
+	sniff   []byte
+	body    bytes.Buffer
+	scan    formScanner
+}
+
+// newInjectWriter returns a writer that adds the hidden inputs
+func newInjectWriter(w http.ResponseWriter, r *http.Request, rt *requestTokens) *injectWriter {
+	iw := &injectWriter{ResponseWriter: w, r: r, rt: rt}
+	iw.scan.field = iw.field
+	iw.scan.out = iw.out
+	return iw
+}
+
+// hijackInjectWriter is an injectWriter for a ResponseWriter that supports
+// hijacking
+type hijackInjectWriter struct {
+	*injectWriter
+}
+
+// Hijack lets the handler take over the connection
+func (iw hijackInjectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return iw.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// responseWriter returns the injectWriter as an http.Hijacker only if the
+// wrapped ResponseWriter is one
+func (iw *injectWriter) responseWriter() http.ResponseWriter {
+	if _, ok := iw.ResponseWriter.(http.Hijacker); ok {
+		return hijackInjectWriter{iw}
+	}
+	return iw
+}
+
+// ReadFrom copies the body through the scanner, or with the io.ReaderFrom of
+// the wrapped ResponseWriter once the response is known not to be HTML
+func (iw *injectWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !iw.decided && iw.Header().Get("Content-Type") != "" {
+		if iw.code == 0 {
+			iw.WriteHeader(http.StatusOK)
+		}
+		iw.decide(nil)
+		iw.writeHeader()
+	}
+	if iw.decided && !iw.active {
+		if rf, ok := iw.ResponseWriter.(io.ReaderFrom); ok {
+			return rf.ReadFrom(src)
+		}
+	}
+	return io.Copy(writerOnly{iw}, src)
+}
+
+// Push starts an HTTP/2 server push if it's supported
+func (iw *injectWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := iw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the wrapped ResponseWriter for http.ResponseController
+func (iw *injectWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// decide checks if the response is HTML the first time it's written
+func (iw *injectWriter) decide(b []byte) {
+	if iw.decided {
+		return
+	}
+	iw.decided = true
+
+	header := iw.Header()
+	contentType := header.Get("Content-Type")
+	if contentType == "" && len(b) > 0 {
+		contentType = http.DetectContentType(b)
+	}
+
+	if !strings.HasPrefix(strings.ToLower(contentType), "text/html") ||
+		header.Get("Content-Encoding") != "" {
+		return
+	}
+
+	// The length changes when the inputs are added
+	iw.active = true
+	header.Del("Content-Length")
+
+	// Stored tokens may have to be added to the session after the headers
+	// would be written, so wait until the end of the request
+	iw.buffer = iw.rt.h.cookie == nil && iw.rt.h.derived == nil
+	if !iw.buffer {
+		// Create the secret now so it's sent with the headers
+		iw.rt.token(tokenPath(iw.r, iw.rt.h.Options()))
+	}
+}
+
+// writeHeader writes the headers once the response type is known
+func (iw *injectWriter) writeHeader() {
+	if iw.pending && !iw.buffer {
+		iw.pending = false
+		iw.ResponseWriter.WriteHeader(iw.code)
+	}
+}
+
+// WriteHeader holds the headers until the body is written
+func (iw *injectWriter) WriteHeader(code int) {
+	if iw.code != 0 {
+		return
+	}
+	iw.code = code
+	iw.pending = true
+	if iw.decided {
+		iw.writeHeader()
+	}
+}
+
+// Write scans the body for forms
+func (iw *injectWriter) Write(b []byte) (int, error) {
+	if iw.code == 0 {
+		iw.WriteHeader(http.StatusOK)
+	}
+
+	// Without a Content-Type, wait for enough of the body to detect it,
+	// like net/http does
+	if !iw.decided && iw.Header().Get("Content-Type") == "" {
+		iw.sniff = append(iw.sniff, b...)
+		if len(iw.sniff) < 512 {
+			return len(b), nil
+		}
+		iw.writeSniffed()
+		return len(b), nil
+	}
+
+	iw.decide(b)
+	iw.writeHeader()
+	return len(b), iw.write(b)
+}
+
+// writeSniffed decides what to do with the start of the body that was held
+// back and writes it
+func (iw *injectWriter) writeSniffed() {
+	b := iw.sniff
+	iw.sniff = nil
+	iw.decide(b)
+	iw.writeHeader()
+	if len(b) > 0 {
+		iw.write(b)
+	}
+}
+
+// write scans the body or writes it as is
+func (iw *injectWriter) write(b []byte) error {
+	if !iw.active {
+		_, err := iw.ResponseWriter.Write(b)
+		return err
+	}
+	iw.scan.write(b)
+	return nil
+}
+
+// Flush writes the scanned body unless the response is buffered
+func (iw *injectWriter) Flush() {
+	iw.writeSniffed()
+	if iw.buffer {
+		return
+	}
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the rest of the body and, if the response is buffered, the
+// headers and the body
+func (iw *injectWriter) finish() {
+	iw.writeSniffed()
+	if !iw.active {
+		return
+	}
+	iw.scan.close()
+
+	if iw.buffer {
+		if iw.code == 0 {
+			iw.code = http.StatusOK
+		}
+		iw.ResponseWriter.WriteHeader(iw.code)
+		iw.ResponseWriter.Write(iw.body.Bytes())
+	}
+}
+
+// out writes the scanned body
+func (iw *injectWriter) out(b []byte) {
+	if iw.buffer {
+		iw.body.Write(b)
+		return
+	}
+	iw.ResponseWriter.Write(b)
+}
+
+// field returns the hidden input for a form with the action, or an empty
+// string if the form should be left alone
+func (iw *injectWriter) field(action string) string {
+	u, err := iw.r.URL.Parse(action)
+	if err != nil {
+		return ""
+	}
+
+	// Never send the token to another host. Behind a trusted proxy, the
+	// host is the one the client sent the request to.
+	if u.Host != "" && !strings.EqualFold(u.Host, iw.rt.h.requestOrigin(iw.r).Host) {
+		return ""
+	}
+
+	path := u.Path
+	if path == "" || iw.rt.h.Options().SingleToken {
+		path = "/"
+	}
+
+	return string(hiddenField(iw.r, iw.rt.token(path)))
+}
+
+// Scanner states
+const (
+	scanTag = iota
+	scanComment
+	scanRawText
+)
+
+// formScanner finds the start tags of forms in HTML that is written in
+// pieces. Everything is passed to out as is, with the hidden input added
+// after each form that needs one.
+type formScanner struct {
+	field  func(action string) string
+	out    func([]byte)
+	state  int
+	tag    []byte
+	quote  byte
+	rawEnd string
+}
+
+// write scans the next piece of the body
+func (s *formScanner) write(b []byte) {
+	// Text from start to i hasn't been written yet
+	start := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if len(s.tag) == 0 {
+			if c == '<' {
+				s.out(b[start:i])
+				s.tag = append(s.tag, c)
+			}
+			continue
+		}
+
+		s.tag = append(s.tag, c)
+		if s.scan(c) {
+			if len(s.tag) == 0 {
+				start = i + 1
+			}
+			continue
+		}
+
+		// The last character wasn't part of the tag, write the rest as text
+		s.tag = s.tag[:len(s.tag)-1]
+		s.flushTag()
+		start = i
+		if c == '<' {
+			s.tag = append(s.tag, c)
+			start = i + 1
+		}
+	}
+
+	if len(s.tag) == 0 && start < len(b) {
+		s.out(b[start:])
+	}
+}
+
+// scan handles the next character of a pending tag and returns false if it
+// isn't part of the tag
+func (s *formScanner) scan(c byte) bool {
+	switch s.state {
+	case scanComment:
+		if bytes.HasSuffix(s.tag, []byte("-->")) {
+			s.flushTag()
+			s.state = scanTag
+		}
+		return true
+	case scanRawText:
+		// Look for the end tag of a script, style, textarea, or title
+		if len(s.tag) <= len(s.rawEnd) {
+			return strings.EqualFold(string(s.tag), s.rawEnd[:len(s.tag)])
+		}
+		if c != '>' && c != '/' && !isSpace(c) {
+			return false
+		}
+		s.state = scanTag
+	}
+
+	switch {
+	case len(s.tag) == 2 && !isTagStart(c):
+		// Not a tag, like "a < b"
+		return false
+	case len(s.tag) == 4 && string(s.tag) == "<!--":
+		s.state = scanComment
+	case s.quote != 0:
+		if c == s.quote {
+			s.quote = 0
+		}
+	case c == '"' || c == '\'':
+		s.quote = c
+	case c == '>':
+		s.endTag()
+	}
+	return true
+}
+
+// endTag handles a complete tag
+func (s *formScanner) endTag() {
+	tag := string(s.tag)
+	name, attrs := parseTag(tag)
+	s.flushTag()
+	s.state = scanTag
+
+	if sContains(rawTextTags, name) {
+		s.state = scanRawText
+		s.rawEnd = "</" + name
+		return
+	}
+
+	if name != "form" || !strings.EqualFold(attrs["method"], "post") {
+		return
+	}
+	if _, skip := attrs["data-csrf-skip"]; skip {
+		return
+	}
+	if field := s.field(attrs["action"]); field != "" {
+		s.out([]byte(field))
+	}
+}
+
+// flushTag writes the pending tag as is
+func (s *formScanner) flushTag() {
+	if len(s.tag) > 0 {
+		s.out(s.tag)
+		s.tag = s.tag[:0]
+	}
+	s.quote = 0
+}
+
+// isSpace returns true for HTML whitespace
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// close writes anything that is still pending
+func (s *formScanner) close() {
+	s.flushTag()
+}
+
+// isTagStart returns true if the character after "<" starts a tag
+func isTagStart(c byte) bool {
+	return c == '/' || c == '!' || c == '?' || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
+
+// parseTag returns the lowercase name of a start tag and its attributes. The
+// name of an end tag starts with "/".
+func parseTag(tag string) (string, map[string]string) {
+	tag = strings.TrimSuffix(strings.TrimPrefix(tag, "<"), ">")
+	tag = strings.TrimSuffix(tag, "/")
+
+	i := strings.IndexAny(tag, " \t\n\r\f/")
+	if i < 0 {
+		return strings.ToLower(tag), nil
+	}
+	name := strings.ToLower(tag[:i])
+	rest := tag[i:]
+
+	attrs := make(map[string]string)
+	for {
+		rest = strings.TrimLeft(rest, " \t\n\r\f/")
+		if rest == "" {
+			return name, attrs
+		}
+
+		// Attribute name
+		end := strings.IndexAny(rest, " \t\n\r\f/=")
+		if end < 0 {
+			end = len(rest)
+		}
+		key := strings.ToLower(rest[:end])
+		rest = strings.TrimLeft(rest[end:], " \t\n\r\f")
+
+		if !strings.HasPrefix(rest, "=") {
+			attrs[key] = ""
+			continue
+		}
+		rest = strings.TrimLeft(rest[1:], " \t\n\r\f")
+
+		// Attribute value, quoted or not
+		var value string
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			q := rest[0]
+			end = strings.IndexByte(rest[1:], q)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end = strings.IndexAny(rest, " \t\n\r\f")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+
+		if _, ok := attrs[key]; !ok {
+			attrs[key] = html.UnescapeString(value)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+const injectPage = `<!DOCTYPE html>
+<!-- <form method="post"> -->
+<form method="post">A</form>
+<form method="POST" action="/form1?x=1">B</form>
+<form method="get" action="/form1">C</form>
+<form method="post" action="/form1" data-csrf-skip>D</form>
+<form method="post" action="http://example.com/form1">E</form>
+<FORM action='/form1' method=post class="a>b">F</FORM>
+<script>if (a <b) { s = '<form method="post">' }</script>
+<textarea><form method="post"></textarea>
+`
+
+func TestInjectTokens(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Write the page a byte at a time
+	var token, token1 string
+	page := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < len(injectPage); i++ {
+			w.Write([]byte{injectPage[i]})
+		}
+		token = TokenFromRequest(r)
+		token1 = TokenForPath(r, "/form1")
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName)
+	h.InjectTokens(true)
+
+	// Render the page
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+
+	field := `<input type="hidden" name="token" value="` + token + `">`
+	field1 := `<input type="hidden" name="token" value="` + token1 + `">`
+	expected := `<!DOCTYPE html>
+<!-- <form method="post"> -->
+<form method="post">` + field + `A</form>
+<form method="POST" action="/form1?x=1">` + field1 + `B</form>
+<form method="get" action="/form1">C</form>
+<form method="post" action="/form1" data-csrf-skip>D</form>
+<form method="post" action="http://example.com/form1">E</form>
+<FORM action='/form1' method=post class="a>b">` + field1 + `F</FORM>
+<script>if (a <b) { s = '<form method="post">' }</script>
+<textarea><form method="post"></textarea>
+`
+	if w.Body.String() != expected {
+		t.Errorf("Wrong page:\nexpected %v\ngot      %v", expected, w.Body.String())
+	}
+
+	// The tokens are saved in the session
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Session should be saved, got cookies %v", cookies)
+	}
+
+	// Submit the form
+	form := url.Values{}
+	form.Set(TokenName, token1)
+	req, err := http.NewRequest("POST", "http://localhost/form1", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookies[0])
+
+	h = New(http.HandlerFunc(successHandler), store, cookieName)
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("Injected token should be valid, got %v", w.Code)
+	}
+}
+
+func TestInjectTokensBehindProxy(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Forms for the public host and the internal one
+	var token string
+	page := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<form method="post" action="https://public.com/form1">A</form>` +
+			`<form method="post" action="http://localhost/form1">B</form>`))
+		token = TokenForPath(r, "/form1")
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName)
+	h.InjectTokens(true)
+	h.TrustedProxies([]string{"10.0.0.0/8"})
+
+	// Render the page through the proxy
+	req := fakeGet()
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "public.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	field := `<input type="hidden" name="token" value="` + token + `">`
+	expected := `<form method="post" action="https://public.com/form1">` + field + `A</form>` +
+		`<form method="post" action="http://localhost/form1">B</form>`
+	if w.Body.String() != expected {
+		t.Errorf("Wrong page:\nexpected %v\ngot      %v", expected, w.Body.String())
+	}
+}
+
+func TestInjectTokensNotHTML(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	tests := []struct {
+		contentType string
+		encoding    string
+	}{
+		{"application/json", ""},
+		{"text/plain; charset=utf-8", ""},
+		{"text/html; charset=utf-8", "gzip"},
+	}
+
+	for _, tt := range tests {
+		page := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Header().Set("Content-Encoding", tt.encoding)
+			w.WriteHeader(201)
+			w.Write([]byte(injectPage))
+		}
+
+		// Create the handler
+		h := New(http.HandlerFunc(page), store, cookieName)
+		h.InjectTokens(true)
+
+		// Render the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, fakeGet())
+
+		if w.Code != 201 || w.Body.String() != injectPage {
+			t.Errorf("Content type %v with encoding %q should not change, got %v %v", tt.contentType, tt.encoding, w.Code, w.Body.String())
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("Content type %v with encoding %q should not save the session", tt.contentType, tt.encoding)
+		}
+	}
+}
+
+func TestInjectTokensStreaming(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Flush the headers before the form
+	page := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		w.Write([]byte(`<form method="post" action="/form1"></form>`))
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName)
+	h.DerivedTokens([]byte("server-key"))
+	h.InjectTokens(true)
+
+	// Render the page
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+
+	if !w.Flushed {
+		t.Error("Response should be streamed")
+	}
+	if w.Header().Get("Content-Length") != "" {
+		t.Error("Content-Length should be removed")
+	}
+
+	// The secret is saved before the headers are written
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Session should be saved, got cookies %v", cookies)
+	}
+
+	// Find the token in the page
+	body := w.Body.String()
+	start := strings.Index(body, `value="`)
+	if start < 0 {
+		t.Fatalf("Token should be injected, got %v", body)
+	}
+	token := body[start+len(`value="`):]
+	token = token[:strings.Index(token, `"`)]
+
+	// Submit the form
+	form := url.Values{}
+	form.Set(TokenName, token)
+	req, err := http.NewRequest("POST", "http://localhost/form1", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookies[0])
+
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("Injected token should be valid, got %v", w.Code)
+	}
+}
@@ -0,0 +1,90 @@
+package csrfbanana
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// jsonToken returns the string at the JSON pointer in the body of the request
+// and false if it's not there. The whole body is read and put back, so the
+// next handler gets the original body.
+func jsonToken(r *http.Request, o Options) (string, bool) {
+	if r.Body == nil {
+		return "", false
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return "", false
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", false
+	}
+
+	v, ok := lookupPointer(v, jsonPointer(o))
+	if !ok {
+		return "", false
+	}
+
+	// Only a string can be a token
+	t, ok := v.(string)
+	return t, ok
+}
+
+// jsonPointer returns the location of the token in a JSON body
+func jsonPointer(o Options) string {
+	if o.JSONPointer != "" {
+		return o.JSONPointer
+	}
+	r := strings.NewReplacer("~", "~0", "/", "~1")
+	return "/" + r.Replace(o.TokenName)
+}
+
+// validPointer returns true if the pointer is empty or starts with "/", as
+// in RFC 6901
+func validPointer(pointer string) bool {
+	return pointer == "" || strings.HasPrefix(pointer, "/")
+}
+
+// lookupPointer returns the value at the RFC 6901 JSON pointer
+func lookupPointer(v interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" {
+		return v, true
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, false
+	}
+
+	r := strings.NewReplacer("~1", "/", "~0", "~")
+	for _, part := range strings.Split(pointer[1:], "/") {
+		part = r.Replace(part)
+
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			// Array indexes are digits without leading zeros
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) || strconv.Itoa(i) != part {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
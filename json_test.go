@@ -0,0 +1,153 @@
+package csrfbanana
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestJSONToken(t *testing.T) {
+	tests := []struct {
+		pointer string
+		body    string
+		token   string
+		ok      bool
+	}{
+		{"", `{"token": "123456"}`, "123456", true},
+		{"", `{"token": 123456}`, "", false},
+		{"", `{"token": null}`, "", false},
+		{"", `{"other": "123456"}`, "", false},
+		{"", `["123456"]`, "", false},
+		{"", `"123456"`, "", false},
+		{"", `123456`, "", false},
+		{"", `{"token": "123456"`, "", false},
+		{"", ``, "", false},
+		{"/meta/csrf", `{"meta": {"csrf": "123456"}}`, "123456", true},
+		{"/meta/csrf", `{"meta": "123456"}`, "", false},
+		{"/meta/0", `{"meta": ["123456"]}`, "123456", true},
+		{"/meta/00", `{"meta": ["123456"]}`, "", false},
+		{"/meta/1", `{"meta": ["123456"]}`, "", false},
+		{"/a~1b/c~0d", `{"a/b": {"c~d": "123456"}}`, "123456", true},
+	}
+
+	for _, tt := range tests {
+		o := Options{JSONPointer: tt.pointer}.withDefaults()
+
+		req, err := http.NewRequest("POST", "http://localhost/", strings.NewReader(tt.body))
+		if err != nil {
+			panic(err)
+		}
+
+		token, ok := jsonToken(req, o)
+		if token != tt.token || ok != tt.ok {
+			t.Errorf("Pointer %q in %v: expected %q %v, got %q %v", tt.pointer, tt.body, tt.token, tt.ok, token, ok)
+		}
+
+		// The body can be read again
+		b, _ := ioutil.ReadAll(req.Body)
+		if string(b) != tt.body {
+			t.Errorf("Pointer %q in %v: body should not change, got %v", tt.pointer, tt.body, string(b))
+		}
+	}
+}
+
+func TestCSRFJSONNotObject(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Save the reason passed to the failure handler
+	var reason error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		failureHandler500(w, r)
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(successHandler), store, cookieName)
+	h.FailureHandler(http.HandlerFunc(failure))
+
+	for _, body := range []string{`["123456"]`, `"123456"`, `{"token": 123456}`} {
+		reason = nil
+
+		// Create the POST request
+		req, err := http.NewRequest("POST", "http://localhost/", bytes.NewBufferString(body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		// Run the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if reason != ErrMissingToken {
+			t.Errorf("Body %v: expected reason %v, got %v", body, ErrMissingToken, reason)
+		}
+	}
+}
+
+func TestCSRFJSONPointer(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Read the body in the next handler
+	var body string
+	page := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		successHandler(w, r)
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName, Options{JSONPointer: "/meta/csrf"})
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+
+	// Render the form
+	w := httptest.NewRecorder()
+	get := fakeGet()
+	sess, err := store.Get(get, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	token := h.Token(w, get, sess)
+
+	// A large body is passed on in full
+	jsonValue := `{"meta": {"csrf": "` + token + `"}, "data": "` + strings.Repeat("a", 1<<16) + `"}`
+
+	// Create the POST request
+	req, err := http.NewRequest("POST", "http://localhost/", bytes.NewBufferString(jsonValue))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(w.Result().Cookies()[0])
+
+	// Run the page
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("The request should have succeeded, but it didn't. Instead, the code was %d", w.Code)
+	}
+	if body != jsonValue {
+		t.Errorf("The next handler should get the whole body, got %v bytes", len(body))
+	}
+}
+
+func TestInvalidJSONPointer(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("New should panic on an invalid JSON pointer")
+		}
+	}()
+	New(http.HandlerFunc(successHandler), nil, "", Options{JSONPointer: "meta/csrf"})
+}
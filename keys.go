@@ -0,0 +1,107 @@
+package csrfbanana
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// Key is a secret used to sign cookies and derive tokens. The ID is stored
+// with every signed value so the key can be found again when verifying.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// keyRing is an ordered list of keys. The first key signs and every key
+// verifies, so keys can be rotated without rejecting existing values.
+type keyRing struct {
+	keys []Key
+}
+
+// SigningKeys sets the keys used by DoubleSubmitCookie and DerivedTokens.
+// The first key signs new values and every key is used to verify. To rotate,
+// add the new key to the front and remove the oldest key once the values it
+// signed have expired.
+func (h *CSRFHandler) SigningKeys(keys []Key) {
+	h.keys.set(keys)
+}
+
+// set replaces the keys and panics if any of them are not valid
+func (k *keyRing) set(keys []Key) {
+	if len(keys) == 0 {
+		panic("csrfbanana: at least one signing key is needed")
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ".") || len(key.Secret) == 0 {
+			panic("csrfbanana: signing key needs an ID without a dot and a secret")
+		}
+		if seen[key.ID] {
+			panic("csrfbanana: duplicate signing key ID " + key.ID)
+		}
+		seen[key.ID] = true
+	}
+
+	k.keys = append([]Key(nil), keys...)
+}
+
+// primary returns the key used to sign
+func (k *keyRing) primary() Key {
+	if len(k.keys) == 0 {
+		panic("csrfbanana: no signing key is set")
+	}
+	return k.keys[0]
+}
+
+// find returns the key with the ID
+func (k *keyRing) find(id string) (Key, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// mac returns the HMAC of the parts. The purpose keeps a value signed for
+// one use from being accepted for another.
+func (k *keyRing) mac(key Key, purpose string, parts ...string) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(purpose))
+	for _, p := range parts {
+		mac.Write([]byte{0})
+		mac.Write([]byte(p))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns "id.payload.signature" using the primary key. The payload
+// must not contain a dot.
+func (k *keyRing) sign(purpose, payload string) string {
+	key := k.primary()
+	return key.ID + "." + payload + "." + k.mac(key, purpose, payload)
+}
+
+// verify returns the payload if the signature is valid. current is false if
+// the value was signed by a key other than the primary key.
+func (k *keyRing) verify(purpose, value string) (payload string, current bool, ok bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return "", false, false
+	}
+
+	key, found := k.find(parts[0])
+	if !found {
+		return "", false, false
+	}
+
+	expected := k.mac(key, purpose, parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return "", false, false
+	}
+
+	return parts[1], key.ID == k.primary().ID, true
+}
@@ -0,0 +1,142 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestKeyRingSignVerify(t *testing.T) {
+	k := &keyRing{}
+	k.set([]Key{{ID: "a", Secret: []byte("secret-key")}})
+
+	signed := k.sign("cookie", "payload|123")
+	if !strings.HasPrefix(signed, "a.") {
+		t.Errorf("Signed value should start with the key ID, got %v", signed)
+	}
+	if payload, current, ok := k.verify("cookie", signed); !ok || !current || payload != "payload|123" {
+		t.Errorf("Signed value should verify: expected %v, got %v", "payload|123", payload)
+	}
+
+	other := &keyRing{}
+	other.set([]Key{{ID: "a", Secret: []byte("other-key")}})
+	parts := strings.Split(signed, ".")
+
+	for _, bad := range []string{
+		"",
+		"payload|123",
+		parts[0] + ".payload|124." + parts[2],
+		"b." + parts[1] + "." + parts[2],
+		signed + "x",
+		other.sign("cookie", "payload|123"),
+	} {
+		if _, _, ok := k.verify("cookie", bad); ok {
+			t.Errorf("Value %q should not verify", bad)
+		}
+	}
+
+	// A value signed for another purpose
+	if _, _, ok := k.verify("token", signed); ok {
+		t.Error("Value signed for a cookie should not verify as a token")
+	}
+}
+
+func TestKeyRingInvalid(t *testing.T) {
+	tests := [][]Key{
+		nil,
+		{{ID: "", Secret: []byte("secret")}},
+		{{ID: "a.b", Secret: []byte("secret")}},
+		{{ID: "a", Secret: nil}},
+		{{ID: "a", Secret: []byte("1")}, {ID: "a", Secret: []byte("2")}},
+	}
+
+	for _, keys := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Keys %v should have panicked", keys)
+				}
+			}()
+			(&keyRing{}).set(keys)
+		}()
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	k1 := Key{ID: "1", Secret: []byte("first-key")}
+	k2 := Key{ID: "2", Secret: []byte("second-key")}
+	k3 := Key{ID: "3", Secret: []byte("third-key")}
+
+	// Create the handler without a session store
+	h := New(http.HandlerFunc(successHandler), nil, "")
+	h.DoubleSubmitCookie("csrf", nil)
+	h.DerivedTokens(nil)
+
+	// issue returns a token and cookie signed with the current keys
+	issue := func() (string, *http.Cookie) {
+		w := httptest.NewRecorder()
+		token := h.Token(w, fakeGet(), nil)
+		return token, w.Result().Cookies()[0]
+	}
+
+	// post returns the status code of a request with the token and cookie
+	post := func(token string, cookie *http.Cookie) int {
+		form := url.Values{}
+		form.Set(TokenName, token)
+		req := fakePost(form)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	h.SigningKeys([]Key{k1})
+	token1, cookie1 := issue()
+
+	// Rotate in the second key
+	h.SigningKeys([]Key{k2, k1})
+	token2, cookie2 := issue()
+
+	if !strings.HasPrefix(token2, "2.") || !strings.HasPrefix(cookie2.Value, "2.") {
+		t.Errorf("New values should be signed with key 2, got %v and %v", token2, cookie2.Value)
+	}
+	if code := post(token1, cookie1); code != 200 {
+		t.Errorf("Values signed with key 1 should still work, got %d", code)
+	}
+
+	// A cookie signed with an older key is signed again
+	w := httptest.NewRecorder()
+	req := fakeGet()
+	req.AddCookie(cookie1)
+	h.Token(w, req, nil)
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || !strings.HasPrefix(cookies[0].Value, "2.") {
+		t.Errorf("Cookie should have been signed again with key 2, got %v", cookies)
+	}
+
+	// Rotate in the third key and drop the first
+	h.SigningKeys([]Key{k3, k2})
+	token3, cookie3 := issue()
+
+	tests := []struct {
+		name   string
+		token  string
+		cookie *http.Cookie
+		code   int
+	}{
+		{"key 1", token1, cookie1, 400},
+		{"key 2", token2, cookie2, 200},
+		{"key 3", token3, cookie3, 200},
+		// Token signed with key 1 but cookie with key 3
+		{"key 1 token", token1, cookie3, 400},
+	}
+
+	for _, tt := range tests {
+		if code := post(tt.token, tt.cookie); code != tt.code {
+			t.Errorf("Values signed with %v: expected code %d, got %d", tt.name, tt.code, code)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package csrfbanana
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+)
+
+// multipartToken reads a multipart/form-data body up to the part with the
+// token. The token must come before any file, so an upload is never read for
+// a request without a token. At most MultipartMaxBytes are held in memory,
+// and the body is put back together for the next handler.
+func multipartToken(r *http.Request, o Options) (string, bool) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" || r.Body == nil {
+		return "", false
+	}
+
+	// Keep what is read so the next handler gets the whole body
+	var read bytes.Buffer
+	body := r.Body
+	defer func() {
+		r.Body = readCloser{io.MultiReader(&read, body), body}
+	}()
+
+	limited := io.LimitReader(body, o.MultipartMaxBytes)
+	mr := multipart.NewReader(io.TeeReader(limited, &read), params["boundary"])
+
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return "", false
+		}
+
+		// Don't read past the start of a file
+		if p.FileName() != "" {
+			return "", false
+		}
+
+		if p.FormName() == o.TokenName {
+			b, err := ioutil.ReadAll(p)
+			if err != nil {
+				return "", false
+			}
+			return string(b), true
+		}
+	}
+}
+
+// readCloser reads from a Reader and closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,137 @@
+package csrfbanana
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// multipartBody returns a form with the fields in order. A field named
+// "file" is sent as a file.
+func multipartBody(fields ...string) (string, string) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for i := 0; i < len(fields); i += 2 {
+		if fields[i] == "file" {
+			fw, _ := mw.CreateFormFile("file", "upload.txt")
+			fw.Write([]byte(fields[i+1]))
+		} else {
+			mw.WriteField(fields[i], fields[i+1])
+		}
+	}
+	mw.Close()
+	return b.String(), mw.FormDataContentType()
+}
+
+func TestCSRFMultipart(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Read the upload in the next handler
+	var upload string
+	page := func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("Error reading the upload: %v", err)
+			return
+		}
+		b, _ := ioutil.ReadAll(f)
+		upload = string(b)
+		successHandler(w, r)
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName, Options{MultipartMaxBytes: 1024})
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+
+	// Render the form
+	w := httptest.NewRecorder()
+	get := fakeGet()
+	sess, err := store.Get(get, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	token := h.Token(w, get, sess)
+	cookie := w.Result().Cookies()[0]
+
+	file := strings.Repeat("a", 1<<20)
+	tests := []struct {
+		fields []string
+		code   int
+	}{
+		{[]string{"title", "t", TokenName, token, "file", file}, 200},
+		{[]string{"file", file, TokenName, token}, 500},
+		{[]string{"title", strings.Repeat("t", 2048), TokenName, token, "file", file}, 500},
+		{[]string{"title", "t", "file", file}, 500},
+	}
+
+	for i, tt := range tests {
+		upload = ""
+
+		// Create the POST request
+		body, contentType := multipartBody(tt.fields...)
+		req, err := http.NewRequest("POST", "http://localhost/", strings.NewReader(body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.AddCookie(cookie)
+
+		// Run the page
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("Test %v: expected code %v, got %v", i, tt.code, w.Code)
+		}
+		if tt.code == 200 && upload != file {
+			t.Errorf("Test %v: the next handler should get the whole upload, got %v bytes", i, len(upload))
+		}
+	}
+}
+
+func TestCSRFMultipartHeader(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler
+	h := New(http.HandlerFunc(successHandler), store, cookieName)
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+
+	// Render the form
+	w := httptest.NewRecorder()
+	get := fakeGet()
+	sess, err := store.Get(get, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	token := h.Token(w, get, sess)
+
+	// The file comes first, so the token is sent in the header
+	body, contentType := multipartBody("file", "data", TokenName, "wrong")
+	req, err := http.NewRequest("POST", "http://localhost/", strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(TokenHeader, token)
+	req.AddCookie(w.Result().Cookies()[0])
+
+	// Run the page
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("The request should have succeeded, but it didn't. Instead, the code was %d", w.Code)
+	}
+}
@@ -0,0 +1,234 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// PerRequest gives every render of a form its own token that can only be
+// used once, so a submitted form can't be replayed. Up to n unused tokens
+// are kept for each path, so several open tabs with the same form still
+// work. When there are more, the oldest stops working. Zero, the default,
+// uses one token per path. It is ignored with DerivedTokens and
+// DoubleSubmitCookie.
+//
+// A token is only used up atomically with an AtomicTokenStore. With other
+// stores, two requests sent at the same time can both use it.
+func (h *CSRFHandler) PerRequest(n int) {
+	h.perRequest = n
+}
+
+// issueNonce generates a new single-use token for urlPath. At most n unused
+// tokens are kept for the path.
+func issueNonce(sess *sessions.Session, urlPath string, o Options, n int) (string, bool) {
+	nonces := nonceMap(sess, o, true)
+	if _, ok := nonces[urlPath]; !ok {
+		nonces.evict(o.MaxTokens)
+	}
+
+	// Drop the oldest tokens to make room
+	entries := nonces[urlPath]
+	if len(entries) >= n {
+		entries = entries[len(entries)-n+1:]
+	}
+	entry := TokenEntry{
+		Value:  generate(o.TokenLength),
+		Issued: now(),
+	}
+	nonces[urlPath] = append(append([]TokenEntry(nil), entries...), entry)
+
+	if o.Masked {
+		return maskToken(entry.Value), true
+	}
+	return entry.Value, true
+}
+
+// nonceMap returns the single-use tokens stored in the session. Tokens stored
+// by the other modes are converted so the forms that are already open still
+// work. If create is true, a missing map is added to the session, otherwise
+// nil is returned.
+func nonceMap(sess *sessions.Session, o Options, create bool) NonceMap {
+	if m, ok := sess.Values[o.TokenName].(NonceMap); ok {
+		return m
+	}
+
+	tokens := tokenMap(sess, o, false)
+	if tokens == nil && !create {
+		return nil
+	}
+
+	m := make(NonceMap, len(tokens))
+	for path, entry := range tokens {
+		m[path] = []TokenEntry{entry}
+	}
+	sess.Values[o.TokenName] = m
+	return m
+}
+
+// evict removes the paths with the least recently issued tokens until there
+// is room for one more path without going over max
+func (m NonceMap) evict(max int) {
+	for len(m) > 0 && len(m) >= max {
+		oldest := ""
+		for path, entries := range m {
+			if oldest == "" || newest(entries).Before(newest(m[oldest])) ||
+				(newest(entries).Equal(newest(m[oldest])) && path < oldest) {
+				oldest = path
+			}
+		}
+		delete(m, oldest)
+	}
+}
+
+// newest returns the time the last token in the list was issued
+func newest(entries []TokenEntry) time.Time {
+	if len(entries) == 0 {
+		return time.Time{}
+	}
+	return entries[len(entries)-1].Issued
+}
+
+// matchNonce returns nil if the sent token is one of the unused tokens for
+// the URL. The token is used up, even if it has expired. If refresh is true,
+// the other tokens for the path are deleted too.
+func matchNonce(r *http.Request, sess *sessions.Session, o Options, refresh bool) error {
+	path := tokenPath(r, o)
+
+	// Token submitted via header or POST
+	sentToken, err := readToken(r, o)
+
+	// If tokens don't exist
+	nonces := nonceMap(sess, o, false)
+	if nonces == nil {
+		if sentToken == "" && err == nil {
+			return ErrMissingToken
+		}
+		return ErrBadToken
+	}
+
+	if refresh {
+		defer delete(nonces, path)
+	}
+
+	// A token that can't be unmasked fails like a wrong one
+	if err != nil {
+		return err
+	}
+
+	// If token is empty in the form, it is not valid
+	if sentToken == "" {
+		return ErrMissingToken
+	}
+
+	return checkPaths(r, path, func(p string) error {
+		return nonces.use(p, sentToken, o)
+	})
+}
+
+// useNonce matches the sent token and uses it up in a single Update, so
+// another request can't use it at the same time. The session loaded later in
+// the request doesn't have the used token.
+func (h *CSRFHandler) useNonce(w http.ResponseWriter, r *http.Request, store AtomicTokenStore, o Options) error {
+	var err error
+	updateErr := store.Update(w, r, o.TokenName, func(value interface{}) interface{} {
+		sess := sessions.NewSession(nil, o.TokenName)
+		if value != nil {
+			sess.Values[o.TokenName] = value
+		}
+		err = matchNonce(r, sess, o, h.regenerateAfterUsage)
+		return sess.Values[o.TokenName]
+	})
+	if updateErr != nil {
+		return ErrSessionUnavailable
+	}
+	return err
+}
+
+// nonceSet returns the path and value of every nonce in a NonceMap
+func nonceSet(value interface{}) map[string]bool {
+	nonces, ok := value.(NonceMap)
+	if !ok {
+		return nil
+	}
+	set := make(map[string]bool)
+	for path, entries := range nonces {
+		for _, entry := range entries {
+			set[path+"\x00"+entry.Value] = true
+		}
+	}
+	return set
+}
+
+// mergeNonces applies the changes a request made to the nonces it loaded to
+// the nonces stored now. Nonces used or issued by other requests in the
+// meantime stay that way. At most n nonces are kept per path and max paths in
+// total.
+func mergeNonces(stored interface{}, loaded map[string]bool, changed NonceMap, n, max int) interface{} {
+	current, ok := stored.(NonceMap)
+	if !ok && stored != nil {
+		// Another mode stored the tokens, so there is nothing to merge
+		return changed
+	}
+
+	kept := nonceSet(changed)
+	merged := make(NonceMap)
+
+	// Keep the stored nonces the request didn't use up
+	for path, entries := range current {
+		for _, entry := range entries {
+			key := path + "\x00" + entry.Value
+			if !loaded[key] || kept[key] {
+				merged[path] = append(merged[path], entry)
+			}
+		}
+	}
+
+	// Add the nonces the request issued
+	for path, entries := range changed {
+		for _, entry := range entries {
+			if !loaded[path+"\x00"+entry.Value] {
+				merged[path] = append(merged[path], entry)
+			}
+		}
+	}
+
+	for path, entries := range merged {
+		if n > 0 && len(entries) > n {
+			merged[path] = entries[len(entries)-n:]
+		}
+	}
+	merged.evict(max + 1)
+
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// use deletes the sent token from the tokens for the path. Every token is
+// compared so the time doesn't depend on which one matches.
+func (m NonceMap) use(path, sentToken string, o Options) error {
+	entries := m[path]
+	found := -1
+	for i, entry := range entries {
+		if compareTokens(sentToken, entry.Value) && found < 0 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return ErrBadToken
+	}
+
+	entry := entries[found]
+	m[path] = append(entries[:found:found], entries[found+1:]...)
+	if len(m[path]) == 0 {
+		delete(m, path)
+	}
+
+	if entry.expired(o) {
+		return ErrExpiredToken
+	}
+	return nil
+}
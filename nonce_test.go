@@ -0,0 +1,227 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestPerRequest(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Save the reason passed to the failure handler
+	var reason error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		failureHandler500(w, r)
+	}
+
+	// Render the form in the next handler
+	var token string
+	page := func(w http.ResponseWriter, r *http.Request) {
+		token = TokenFromRequest(r)
+		successHandler(w, r)
+	}
+
+	// Create the handler
+	h := New(http.HandlerFunc(page), store, cookieName)
+	h.FailureHandler(http.HandlerFunc(failure))
+	h.PerRequest(3)
+
+	// Send the session cookie back with every request
+	var cookie *http.Cookie
+	serve := func(req *http.Request) {
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+	}
+	post := func(token string) error {
+		reason = nil
+		form := url.Values{}
+		form.Set(TokenName, token)
+		req := fakePost(form)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		serve(req)
+		return reason
+	}
+
+	// Open the form in four tabs
+	var tokens []string
+	for i := 0; i < 4; i++ {
+		serve(fakeGet())
+		tokens = append(tokens, token)
+	}
+
+	// Every render has its own token
+	for i := range tokens {
+		for j := range tokens[:i] {
+			if tokens[i] == tokens[j] {
+				t.Errorf("Tokens %v and %v should be different", i, j)
+			}
+		}
+	}
+
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{tokens[0], ErrBadToken}, // Only three tokens are kept
+		{tokens[2], nil},
+		{tokens[2], ErrBadToken}, // Replayed
+		{tokens[1], nil},
+		{tokens[3], nil},
+		{tokens[3], ErrBadToken},
+		{"", ErrMissingToken},
+	}
+
+	for i, tt := range tests {
+		if err := post(tt.token); err != tt.err {
+			t.Errorf("Test %v: expected reason %v, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestPerRequestTokenMap(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the request
+	r := fakeGet()
+
+	// Get the session
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Set the values in the session manually
+	sess.Values[TokenName] = TokenMap{"/": TokenEntry{Value: "123456", Issued: now()}}
+
+	// The token from before is used once
+	nonces := nonceMap(sess, DefaultOptions(), false)
+	if err := nonces.use("/", "123456", DefaultOptions()); err != nil {
+		t.Errorf("Stored token should be valid, got %v", err)
+	}
+	if err := nonces.use("/", "123456", DefaultOptions()); err != ErrBadToken {
+		t.Errorf("Stored token should be used up, got %v", err)
+	}
+	if _, ok := sess.Values[TokenName].(NonceMap); !ok {
+		t.Errorf("Session should have a NonceMap, got %T", sess.Values[TokenName])
+	}
+}
+
+// barrierStore makes the first n calls to Get or Update wait until all of
+// them have been made. Get waits after reading, so every request loads the
+// tokens before any of them can save.
+type barrierStore struct {
+	*ServerTokenStore
+	mu    sync.Mutex
+	n     int
+	ready chan struct{}
+}
+
+func (s *barrierStore) wait() {
+	s.mu.Lock()
+	s.n--
+	if s.n == 0 {
+		close(s.ready)
+	}
+	s.mu.Unlock()
+	<-s.ready
+}
+
+func (s *barrierStore) Get(r *http.Request, key string) (interface{}, error) {
+	v, err := s.ServerTokenStore.Get(r, key)
+	s.wait()
+	return v, err
+}
+
+func (s *barrierStore) Update(w http.ResponseWriter, r *http.Request, key string, fn func(value interface{}) interface{}) error {
+	s.wait()
+	return s.ServerTokenStore.Update(w, r, key, fn)
+}
+
+func TestPerRequestConcurrentReplay(t *testing.T) {
+	store := NewServerTokenStore(ServerStoreOptions{})
+	defer store.Close()
+
+	// Render the form
+	h := serverStoreHandler(store)
+	h.PerRequest(5)
+	id, token := serverStoreClient(h)
+
+	// Submit the form many times at once, and load the tokens in every
+	// request before any of them is saved
+	const n = 20
+	h.Store(&barrierStore{ServerTokenStore: store, n: n, ready: make(chan struct{})})
+
+	var wg sync.WaitGroup
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serverStorePost(h, id, token)
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	// The token is only accepted once
+	accepted := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("Token should be accepted once, got %v", accepted)
+	}
+
+	// The pages rendered by the requests didn't store it again
+	h.Store(store)
+	if code := serverStorePost(h, id, token); code != http.StatusInternalServerError {
+		t.Errorf("Used token should fail, got %v", code)
+	}
+}
+
+func TestMergeNonces(t *testing.T) {
+	entry := func(v string) TokenEntry { return TokenEntry{Value: v} }
+
+	// The request loaded a and b, used b, and issued c
+	loaded := nonceSet(NonceMap{"/": {entry("a"), entry("b")}})
+	changed := NonceMap{"/": {entry("a"), entry("c")}}
+
+	// Meanwhile, another request used a and issued d
+	stored := NonceMap{"/": {entry("b"), entry("d")}}
+
+	merged, ok := mergeNonces(stored, loaded, changed, 5, 10).(NonceMap)
+	if !ok || len(merged["/"]) != 2 || merged["/"][0].Value != "d" || merged["/"][1].Value != "c" {
+		t.Errorf("Expected d and c, got %v", merged)
+	}
+
+	// At most n nonces are kept
+	merged = mergeNonces(stored, loaded, changed, 1, 10).(NonceMap)
+	if len(merged["/"]) != 1 || merged["/"][0].Value != "c" {
+		t.Errorf("Expected c, got %v", merged)
+	}
+
+	// Nothing left is deleted
+	if v := mergeNonces(nil, loaded, NonceMap{}, 5, 10); v != nil {
+		t.Errorf("Expected nil, got %v", v)
+	}
+}
@@ -25,6 +25,8 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package csrfbanana
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -63,3 +65,46 @@ func defaultFailureHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(FailureCode)
 	fmt.Fprint(w, "Bad Request 400")
 }
+
+// XORs the data with the key in place, both must be the same length
+func oneTimePad(data, key []byte) {
+	n := len(data)
+	if n != len(key) {
+		panic("Lengths of slices are not equal")
+	}
+
+	for i := 0; i < n; i++ {
+		data[i] ^= key[i]
+	}
+}
+
+// Masks the token with a fresh one-time pad so the value sent to the
+// client changes on every render (prevents BREACH). The result is the
+// base64 encoding of pad+masked token.
+func maskToken(token string) string {
+	n := len(token)
+	result := make([]byte, 2*n)
+	key := result[:n]
+	copy(result[n:], token)
+
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	oneTimePad(result[n:], key)
+	return base64.URLEncoding.EncodeToString(result)
+}
+
+// Reverses maskToken. If the value can't be unmasked, ok is false.
+func unmaskToken(masked string) (token string, ok bool) {
+	data, err := base64.URLEncoding.DecodeString(masked)
+	if err != nil || len(data) == 0 || len(data)%2 != 0 {
+		return "", false
+	}
+
+	n := len(data) / 2
+	key := data[:n]
+	t := data[n:]
+	oneTimePad(t, key)
+	return string(t), true
+}
@@ -84,3 +84,27 @@ func TestSameOrigin(t *testing.T) {
 	}
 
 }
+
+func TestMaskUnmaskToken(t *testing.T) {
+	token := "abcdefghijklmnopqrstuvwxyz012345"
+
+	masked1 := maskToken(token)
+	masked2 := maskToken(token)
+
+	if masked1 == masked2 {
+		t.Errorf("Masked tokens should be different every time, but both were %v", masked1)
+	}
+
+	for _, m := range []string{masked1, masked2} {
+		unmasked, ok := unmaskToken(m)
+		if !ok || unmasked != token {
+			t.Errorf("unmaskToken(%v) should be %v, got %v", m, token, unmasked)
+		}
+	}
+
+	for _, bad := range []string{"", "not base64!", "YWJj"} {
+		if _, ok := unmaskToken(bad); ok {
+			t.Errorf("unmaskToken(%q) should have failed, but it didn't.", bad)
+		}
+	}
+}
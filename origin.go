@@ -0,0 +1,218 @@
+package csrfbanana
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPattern is a trusted origin. If wildcard is true, host matches any
+// subdomain of host, but not host itself.
+type originPattern struct {
+	scheme   string
+	host     string
+	port     string
+	wildcard bool
+}
+
+// TrustedOrigins allows unsafe requests from other origins, like
+// "https://app.example.com". A host that starts with "*." matches any
+// subdomain, like "https://*.example.com".
+func (h *CSRFHandler) TrustedOrigins(origins []string) {
+	for _, o := range origins {
+		h.trustedOrigins = append(h.trustedOrigins, mustParseOrigin(o))
+	}
+}
+
+// mustParseOrigin parses a trusted origin and panics if it isn't valid
+func mustParseOrigin(origin string) originPattern {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		panic("csrfbanana: invalid trusted origin " + origin)
+	}
+
+	p := originPattern{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Hostname()),
+		port:   u.Port(),
+	}
+
+	if strings.HasPrefix(p.host, "*.") {
+		p.wildcard = true
+		p.host = p.host[1:]
+	}
+
+	return p
+}
+
+// matches returns true if the URL has the origin of the pattern
+func (p originPattern) matches(u *url.URL) bool {
+	if strings.ToLower(u.Scheme) != p.scheme || u.Port() != p.port {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if p.wildcard {
+		return len(host) > len(p.host) && strings.HasSuffix(host, p.host)
+	}
+	return host == p.host
+}
+
+// TrustedProxies sets the networks, like "10.0.0.0/8", of reverse proxies
+// whose Forwarded, X-Forwarded-Proto, and X-Forwarded-Host headers are used
+// to find the scheme and host the client sent the request to.
+func (h *CSRFHandler) TrustedProxies(cidrs []string) {
+	for _, c := range cidrs {
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			panic("csrfbanana: invalid trusted proxy " + c)
+		}
+		h.trustedProxies = append(h.trustedProxies, network)
+	}
+}
+
+// isTrustedProxy returns true if the request came from a trusted proxy
+func (h *CSRFHandler) isTrustedProxy(r *http.Request) bool {
+	if len(h.trustedProxies) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range h.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the scheme and host the client sent the request to.
+// The scheme is https if the connection uses TLS. Behind a trusted proxy,
+// the forwarded headers are used instead.
+func (h *CSRFHandler) requestOrigin(r *http.Request) *url.URL {
+	u := &url.URL{
+		Scheme: r.URL.Scheme,
+		Host:   r.URL.Host,
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+
+	if h.isTrustedProxy(r) {
+		proto, host := forwarded(r.Header)
+		if proto != "" {
+			u.Scheme = strings.ToLower(proto)
+		}
+		if host != "" {
+			u.Host = host
+		}
+	}
+
+	return u
+}
+
+// forwarded returns the proto and host set by the last proxy. The Forwarded
+// header (RFC 7239) is used if it is set, otherwise X-Forwarded-Proto and
+// X-Forwarded-Host are used.
+func forwarded(header http.Header) (proto, host string) {
+	if f := lastValue(header, "Forwarded"); f != "" {
+		for _, pair := range strings.Split(f, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.Trim(kv[1], `"`)
+			switch strings.ToLower(kv[0]) {
+			case "proto":
+				proto = value
+			case "host":
+				host = value
+			}
+		}
+		return proto, host
+	}
+
+	return lastValue(header, "X-Forwarded-Proto"), lastValue(header, "X-Forwarded-Host")
+}
+
+// lastValue returns the last element of a comma-separated header. It was
+// added by the trusted proxy closest to the server, while the ones before it
+// may come from the client.
+func lastValue(header http.Header, key string) string {
+	values := header[http.CanonicalHeaderKey(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	elements := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(elements[len(elements)-1])
+}
+
+// isTrusted returns true if the URL is the same origin as the request or one
+// of the trusted origins
+func (h *CSRFHandler) isTrusted(u *url.URL, self *url.URL) bool {
+	if sameOrigin(u, self) || h.isUpgraded(u, self) {
+		return true
+	}
+	for _, p := range h.trustedOrigins {
+		if p.matches(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUpgraded returns true if an https URL has the same host as a plain http
+// request and TrustedProxies is not set. TLS then likely ends at a proxy that
+// sends the request on over http, so the browser sends an https Origin. Once
+// TrustedProxies is set, the scheme must match the forwarded one.
+func (h *CSRFHandler) isUpgraded(u *url.URL, self *url.URL) bool {
+	return len(h.trustedProxies) == 0 &&
+		self.Scheme == "http" && strings.ToLower(u.Scheme) == "https" &&
+		strings.EqualFold(u.Hostname(), self.Hostname()) && u.Port() == self.Port()
+}
+
+// checkOrigin returns nil if the request came from a trusted origin. The
+// Origin header is checked and, if it's missing, the Referer is checked
+// instead. Only a secure request must have one of them because browsers
+// don't send the Referer from HTTPS pages to HTTP pages.
+func (h *CSRFHandler) checkOrigin(r *http.Request) error {
+	self := h.requestOrigin(r)
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !h.isTrusted(u, self) {
+			return ErrBadOrigin
+		}
+		return nil
+	}
+
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		if self.Scheme == "https" {
+			return ErrNoReferer
+		}
+		return nil
+	}
+
+	u, err := url.Parse(referer)
+	if err != nil || !h.isTrusted(u, self) {
+		return ErrBadReferer
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package csrfbanana
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestOriginPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		match   bool
+	}{
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "https://APP.example.com", true},
+		{"https://app.example.com", "http://app.example.com", false},
+		{"https://app.example.com", "https://app.example.com:8443", false},
+		{"https://app.example.com:8443", "https://app.example.com:8443", true},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://badexample.com", false},
+		{"https://*.example.com", "https://example.com.evil.com", false},
+	}
+
+	for _, tt := range tests {
+		p := mustParseOrigin(tt.pattern)
+		u := mustParseURL(t, tt.origin)
+		if p.matches(u) != tt.match {
+			t.Errorf("Pattern %v and origin %v: expected %v, got %v", tt.pattern, tt.origin, tt.match, !tt.match)
+		}
+	}
+}
+
+func TestTrustedOriginsInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("TrustedOrigins should have panicked on an invalid origin")
+		}
+	}()
+
+	h := New(http.HandlerFunc(successHandler), sessions.NewCookieStore([]byte("secret-key")), "test")
+	h.TrustedOrigins([]string{"app.example.com"})
+}
+
+func TestCheckOrigin(t *testing.T) {
+	h := New(http.HandlerFunc(successHandler), sessions.NewCookieStore([]byte("secret-key")), "test")
+	h.TrustedOrigins([]string{"https://app.example.com", "https://*.trusted.com"})
+
+	tests := []struct {
+		url     string
+		origin  string
+		referer string
+		err     error
+	}{
+		// Origin header
+		{"https://api.example.com/", "https://api.example.com", "", nil},
+		{"https://api.example.com/", "https://app.example.com", "", nil},
+		{"https://api.example.com/", "https://x.trusted.com", "", nil},
+		{"https://api.example.com/", "https://evil.com", "", ErrBadOrigin},
+		{"https://api.example.com/", "null", "", ErrBadOrigin},
+		{"http://api.example.com/", "https://evil.com", "", ErrBadOrigin},
+		// Origin takes precedence over the Referer
+		{"https://api.example.com/", "https://evil.com", "https://app.example.com/", ErrBadOrigin},
+		// Referer when the Origin is missing
+		{"https://api.example.com/", "", "https://app.example.com/form", nil},
+		{"https://api.example.com/", "", "https://evil.com/form", ErrBadReferer},
+		{"http://api.example.com/", "", "https://evil.com/form", ErrBadReferer},
+		// Neither is set
+		{"https://api.example.com/", "", "", ErrNoReferer},
+		{"http://api.example.com/", "", "", nil},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", tt.url, nil)
+		if err != nil {
+			panic(err)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+
+		if err := h.checkOrigin(req); err != tt.err {
+			t.Errorf("URL %v, origin %q, referer %q: expected %v, got %v",
+				tt.url, tt.origin, tt.referer, tt.err, err)
+		}
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	h := New(http.HandlerFunc(successHandler), sessions.NewCookieStore([]byte("secret-key")), "test")
+	h.TrustedProxies([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		remoteAddr string
+		tls        bool
+		header     map[string]string
+		origin     string
+	}{
+		// Plain server request
+		{"192.0.2.1:1234", false, nil, "http://example.com"},
+		// TLS connection
+		{"192.0.2.1:1234", true, nil, "https://example.com"},
+		// Headers from an untrusted client are ignored
+		{"192.0.2.1:1234", false, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.com"}, "http://example.com"},
+		// Trusted proxy
+		{"10.1.2.3:1234", false, map[string]string{"X-Forwarded-Proto": "https"}, "https://example.com"},
+		{"10.1.2.3:1234", false, map[string]string{"Forwarded": `for=192.0.2.60;proto=https;host="public.com"`}, "https://public.com"},
+		// The last element is added by the trusted proxy, the ones before it
+		// may come from the client
+		{"10.1.2.3:1234", false, map[string]string{"X-Forwarded-Proto": "http, https", "X-Forwarded-Host": "evil.com, public.com"}, "https://public.com"},
+		{"10.1.2.3:1234", false, map[string]string{"Forwarded": "proto=http;host=evil.com, proto=https;host=public.com"}, "https://public.com"},
+		// Forwarded takes precedence over X-Forwarded-*
+		{"10.1.2.3:1234", false, map[string]string{"Forwarded": "proto=https", "X-Forwarded-Proto": "http", "X-Forwarded-Host": "other.com"}, "https://example.com"},
+		// Trusted proxy without headers
+		{"10.1.2.3:1234", true, nil, "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Host = "example.com"
+		req.RemoteAddr = tt.remoteAddr
+		if !tt.tls {
+			req.TLS = nil
+		} else {
+			req.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+
+		if origin := h.requestOrigin(req).String(); origin != tt.origin {
+			t.Errorf("Remote %v, TLS %v, header %v: expected %v, got %v",
+				tt.remoteAddr, tt.tls, tt.header, tt.origin, origin)
+		}
+	}
+}
+
+func TestTrustedProxiesInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("TrustedProxies should have panicked on an invalid network")
+		}
+	}()
+
+	h := New(http.HandlerFunc(successHandler), sessions.NewCookieStore([]byte("secret-key")), "test")
+	h.TrustedProxies([]string{"10.0.0.1"})
+}
+
+func TestCheckOriginBehindProxy(t *testing.T) {
+	h := New(http.HandlerFunc(successHandler), sessions.NewCookieStore([]byte("secret-key")), "test")
+	h.TrustedProxies([]string{"10.0.0.0/8"})
+
+	// The proxy terminates TLS for https://public.com
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Host = "internal:8080"
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "public.com")
+
+	if err := h.checkOrigin(req); err != ErrNoReferer {
+		t.Errorf("Wrong error without a referer: expected %v, got %v", ErrNoReferer, err)
+	}
+
+	req.Header.Set("Referer", "https://public.com/form")
+	if err := h.checkOrigin(req); err != nil {
+		t.Errorf("Referer should match the forwarded origin, but got %v", err)
+	}
+
+	req.Header.Set("Referer", "http://public.com/form")
+	if err := h.checkOrigin(req); err != ErrBadReferer {
+		t.Errorf("Wrong error for an http referer: expected %v, got %v", ErrBadReferer, err)
+	}
+}
+
+func TestCheckOriginBehindUnconfiguredProxy(t *testing.T) {
+	h := New(http.HandlerFunc(successHandler), sessions.NewCookieStore([]byte("secret-key")), "test")
+
+	// The proxy terminates TLS for https://example.com and sends the request
+	// on over http without TrustedProxies being set
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Host = "example.com"
+	req.Header.Set("Origin", "https://example.com")
+
+	if err := h.checkOrigin(req); err != nil {
+		t.Errorf("https origin with the same host should be accepted, but got %v", err)
+	}
+
+	req.Header.Del("Origin")
+	req.Header.Set("Referer", "https://example.com/form")
+	if err := h.checkOrigin(req); err != nil {
+		t.Errorf("https referer with the same host should be accepted, but got %v", err)
+	}
+
+	// Another host or port is still rejected
+	for _, origin := range []string{"https://evil.com", "https://example.com:8443", "ftp://example.com"} {
+		req.Header.Set("Origin", origin)
+		if err := h.checkOrigin(req); err != ErrBadOrigin {
+			t.Errorf("Origin %v: expected %v, got %v", origin, ErrBadOrigin, err)
+		}
+	}
+
+	// Once TrustedProxies is set, the scheme must match
+	h.TrustedProxies([]string{"10.0.0.0/8"})
+	req.Header.Set("Origin", "https://example.com")
+	if err := h.checkOrigin(req); err != ErrBadOrigin {
+		t.Errorf("Expected %v with TrustedProxies set, got %v", ErrBadOrigin, err)
+	}
+}
@@ -0,0 +1,31 @@
+package csrfbanana
+
+import (
+	"net/http"
+)
+
+// OnQueryToken sets a function that is called for each checked request with
+// a token in the URL query string. Use it to find the forms and links that
+// need to change before turning on Options.Strict.
+func (h *CSRFHandler) OnQueryToken(fn func(r *http.Request)) {
+	h.queryTokenHook = fn
+}
+
+// checkQuery reports a token in the URL query string. In strict mode, the
+// token is never read from there, so the request fails with ErrQueryToken
+// instead of ErrMissingToken.
+func (h *CSRFHandler) checkQuery(r *http.Request, err error) error {
+	o := h.Options()
+	if r.URL.Query().Get(o.TokenName) == "" {
+		return err
+	}
+
+	if h.queryTokenHook != nil {
+		h.queryTokenHook(r)
+	}
+
+	if o.Strict && err == ErrMissingToken {
+		return ErrQueryToken
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package csrfbanana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestStrict(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Save the reason passed to the failure handler
+	var reason error
+	failure := func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(r)
+		failureHandler500(w, r)
+	}
+
+	// Count the requests with a token in the query string
+	var warnings int
+	hook := func(r *http.Request) {
+		warnings++
+	}
+
+	form := url.Values{}
+	query := "?" + TokenName + "="
+
+	tests := []struct {
+		strict      bool
+		query       bool
+		contentType string
+		body        bool
+		header      bool
+		err         error
+	}{
+		{true, false, "application/x-www-form-urlencoded", true, false, nil},
+		{true, false, "application/json", true, false, nil},
+		{true, false, "", false, true, nil},
+		{true, true, "application/x-www-form-urlencoded", false, false, ErrQueryToken},
+		{true, true, "application/json", false, false, ErrQueryToken},
+		{true, true, "application/x-www-form-urlencoded", true, false, nil},
+		{true, false, "application/x-www-form-urlencoded", false, false, ErrMissingToken},
+		{false, true, "application/x-www-form-urlencoded", false, false, nil},
+		{false, true, "application/json", false, false, nil},
+	}
+
+	for i, tt := range tests {
+		reason = nil
+		warnings = 0
+
+		// Create the handler
+		h := New(http.HandlerFunc(successHandler), store, cookieName, Options{Strict: tt.strict})
+		h.FailureHandler(http.HandlerFunc(failure))
+		h.OnQueryToken(hook)
+
+		// Render the form
+		w := httptest.NewRecorder()
+		get := fakeGet()
+		sess, err := store.Get(get, cookieName)
+		if err != nil {
+			t.Fatalf("Error getting session: %v", err)
+		}
+		token := h.Token(w, get, sess)
+
+		// Send the token in the query string, body, or header
+		rawurl := "http://localhost/"
+		if tt.query {
+			rawurl += query + token
+		}
+		var body string
+		if tt.body {
+			if tt.contentType == "application/json" {
+				body = `{"token": "` + token + `"}`
+			} else {
+				form.Set(TokenName, token)
+				body = form.Encode()
+			}
+		}
+
+		// Create the POST request
+		req, err := http.NewRequest("POST", rawurl, strings.NewReader(body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.header {
+			req.Header.Set(TokenHeader, token)
+		}
+		req.AddCookie(w.Result().Cookies()[0])
+
+		// Run the page
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if reason != tt.err {
+			t.Errorf("Test %v: expected reason %v, got %v", i, tt.err, reason)
+		}
+		if tt.query && warnings != 1 || !tt.query && warnings != 0 {
+			t.Errorf("Test %v: hook should be called once for a token in the query string, got %v", i, warnings)
+		}
+	}
+}
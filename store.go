@@ -0,0 +1,247 @@
+package csrfbanana
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+// TokenStore stores the tokens of each client between requests. The key is
+// the TokenName and the value is the tokens or secret for the client that
+// sent the request, like a TokenMap. Get returns nil if nothing is stored.
+// Set and Delete are called at most once per request, before the response is
+// written. Clear removes everything stored for the client and is also used
+// to replace a value that can't be read when the StoreErrorPolicy is
+// NewSession.
+type TokenStore interface {
+	Get(r *http.Request, key string) (interface{}, error)
+	Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) error
+	Delete(w http.ResponseWriter, r *http.Request, key string) error
+	Clear(w http.ResponseWriter, r *http.Request) error
+}
+
+// AtomicTokenStore is a TokenStore that can change a value while no other
+// request changes it. With PerRequest, the tokens are used up and saved with
+// Update, so two requests sent at the same time can't use the same token.
+// MemoryTokenStore and ServerTokenStore implement it.
+type AtomicTokenStore interface {
+	TokenStore
+
+	// Update calls fn with the stored value, or nil, and stores the value
+	// it returns. A nil value is deleted.
+	Update(w http.ResponseWriter, r *http.Request, key string, fn func(value interface{}) interface{}) error
+}
+
+// Store sets where the tokens are stored between requests. By default, they
+// are stored in the session passed to New.
+func (h *CSRFHandler) Store(s TokenStore) {
+	h.tokens = s
+	h.customStore = true
+}
+
+// ClearFromRequest removes all the tokens of the client that sent the
+// request, like Clear, from any TokenStore or the DoubleSubmitCookie. Call
+// after a permission change.
+func (h *CSRFHandler) ClearFromRequest(w http.ResponseWriter, r *http.Request) error {
+	if h.cookie != nil {
+		h.cookie.remove(w, r)
+		return nil
+	}
+	if h.tokens == nil {
+		return ErrSessionUnavailable
+	}
+
+	h.forgetTokens(r)
+	return h.tokens.Delete(w, r, h.Options().TokenName)
+}
+
+// isSecure returns true if the client sent the request over https, so
+// cookies set by a TokenStore get the Secure flag. During ServeHTTP, the
+// TrustedProxies of the handler are used to find the scheme.
+func isSecure(r *http.Request) bool {
+	if rt := requestTokensFrom(r); rt != nil {
+		return rt.h.requestOrigin(r).Scheme == "https"
+	}
+	return r.TLS != nil
+}
+
+// usesStore returns true if the tokens must be kept in the TokenStore instead
+// of the session passed in
+func (h *CSRFHandler) usesStore(sess *sessions.Session) bool {
+	return sess == nil || h.customStore
+}
+
+// storeToken returns the token for urlPath from the TokenStore. During
+// ServeHTTP, the tokens are saved at the end of the request.
+func (h *CSRFHandler) storeToken(w http.ResponseWriter, r *http.Request, urlPath string) (string, error) {
+	if rt := requestTokensFrom(r); rt != nil && rt.h == h {
+		if _, err := rt.session(); err != nil {
+			return "", err
+		}
+		return rt.token(urlPath), nil
+	}
+
+	sess, err := h.loadSession(w, r)
+	if err != nil {
+		return "", err
+	}
+	loaded := nonceSet(sess.Values[h.Options().TokenName])
+	t, changed := h.issue(w, r, sess, urlPath, h.Options())
+	if changed {
+		return t, h.saveTokens(w, r, sess, loaded)
+	}
+	return t, nil
+}
+
+// saveTokens stores the tokens from a session loaded by loadSession. Nonces
+// in an AtomicTokenStore are merged with the stored ones, so a nonce used by
+// another request since they were loaded isn't stored again.
+func (h *CSRFHandler) saveTokens(w http.ResponseWriter, r *http.Request, sess *sessions.Session, loaded map[string]bool) error {
+	o := h.Options()
+	value, ok := sess.Values[o.TokenName]
+
+	if nonces, isNonces := value.(NonceMap); isNonces {
+		if store, atomic := h.tokens.(AtomicTokenStore); atomic {
+			return store.Update(w, r, o.TokenName, func(stored interface{}) interface{} {
+				return mergeNonces(stored, loaded, nonces, h.perRequest, o.MaxTokens)
+			})
+		}
+	}
+
+	if ok {
+		return h.tokens.Set(w, r, o.TokenName, value)
+	}
+	return h.tokens.Delete(w, r, o.TokenName)
+}
+
+// forgetTokens drops the tokens loaded during ServeHTTP, so they aren't saved
+// again after they were cleared
+func (h *CSRFHandler) forgetTokens(r *http.Request) {
+	if rt := requestTokensFrom(r); rt != nil && rt.h == h {
+		rt.forget()
+	}
+}
+
+// SessionTokenStore stores the tokens in a gorilla session, next to the
+// other values of the application
+type SessionTokenStore struct {
+	store sessions.Store
+	name  string
+}
+
+// NewSessionTokenStore returns a TokenStore for the session with the name.
+// New uses it for the session store that is passed in.
+func NewSessionTokenStore(store sessions.Store, name string) *SessionTokenStore {
+	return &SessionTokenStore{store: store, name: name}
+}
+
+// replacedSessionKey is the request context key of the session that replaced
+// a broken one in Clear
+type replacedSessionKey struct {
+	store *SessionTokenStore
+}
+
+// session returns the session of the request. gorilla keeps returning the
+// error for a broken session for the rest of the request, so the session
+// that replaced it in Clear is used instead.
+func (s *SessionTokenStore) session(r *http.Request) (*sessions.Session, error) {
+	if sess, ok := r.Context().Value(replacedSessionKey{s}).(*sessions.Session); ok {
+		return sess, nil
+	}
+
+	sess, err := s.store.Get(r, s.name)
+	if err != nil {
+		return nil, err
+	}
+	if sess == nil {
+		return nil, ErrSessionUnavailable
+	}
+	return sess, nil
+}
+
+// Get returns the value from the session
+func (s *SessionTokenStore) Get(r *http.Request, key string) (interface{}, error) {
+	sess, err := s.session(r)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Values[key], nil
+}
+
+// Set stores the value in the session and saves it
+func (s *SessionTokenStore) Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+	sess, err := s.session(r)
+	if err != nil {
+		return err
+	}
+	sess.Values[key] = value
+	return sess.Save(r, w)
+}
+
+// Delete removes the value from the session and saves it
+func (s *SessionTokenStore) Delete(w http.ResponseWriter, r *http.Request, key string) error {
+	sess, err := s.session(r)
+	if err != nil {
+		return err
+	}
+	if _, ok := sess.Values[key]; !ok {
+		return nil
+	}
+	delete(sess.Values, key)
+	return sess.Save(r, w)
+}
+
+// Clear removes the tokens and secrets from the session and leaves the other
+// values. A session that can't be loaded is replaced with a new, empty one,
+// which is used for the rest of the request.
+func (s *SessionTokenStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	sess, err := s.session(r)
+	if err != nil {
+		// Replace the broken cookie with a new session
+		sess, _ = s.store.New(r, s.name)
+		if sess == nil {
+			return ErrSessionUnavailable
+		}
+		sess.Values = make(map[interface{}]interface{})
+		sess.IsNew = true
+		if err := sess.Save(r, w); err != nil {
+			return err
+		}
+		*r = *r.WithContext(context.WithValue(r.Context(), replacedSessionKey{s}, sess))
+		return nil
+	}
+
+	for key, value := range sess.Values {
+		switch value.(type) {
+		case StringMap, TokenMap, NonceMap, derivedSecret:
+			delete(sess.Values, key)
+		}
+	}
+	return sess.Save(r, w)
+}
+
+// errNoClient is returned when a value can't be stored because the client
+// isn't known
+var errNoClient = errors.New("csrfbanana: client is not known")
+
+// encodeValue encodes a value for a store that keeps bytes
+func encodeValue(value interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&value); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decodeValue decodes a value encoded by encodeValue
+func decodeValue(b []byte) (interface{}, error) {
+	var value interface{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,112 @@
+package csrfbanana
+
+import (
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+)
+
+// CookieTokenStore stores the tokens in their own signed and, optionally,
+// encrypted cookie so they don't take up room in the session
+type CookieTokenStore struct {
+	name    string
+	codecs  []securecookie.Codec
+	options http.Cookie
+}
+
+// NewCookieTokenStore returns a TokenStore that keeps the tokens in the
+// cookie with the name. The key pairs are used like with
+// sessions.NewCookieStore: a hash key to sign the cookie and an optional
+// block key to encrypt it, with older pairs after the current one for key
+// rotation.
+func NewCookieTokenStore(name string, keyPairs ...[]byte) *CookieTokenStore {
+	return &CookieTokenStore{
+		name:   name,
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: http.Cookie{
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+}
+
+// values returns the values in the cookie of the request. A missing cookie
+// has no values.
+func (s *CookieTokenStore) values(r *http.Request) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	c, err := r.Cookie(s.name)
+	if err != nil {
+		return values, nil
+	}
+	if err := securecookie.DecodeMulti(s.name, c.Value, &values, s.codecs...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// save writes the values to the cookie of the response and the request, so
+// the rest of the request sees them
+func (s *CookieTokenStore) save(w http.ResponseWriter, r *http.Request, values map[string][]byte) error {
+	c := s.options
+	c.Name = s.name
+	c.Secure = isSecure(r)
+
+	if len(values) == 0 {
+		c.MaxAge = -1
+	} else {
+		encoded, err := securecookie.EncodeMulti(s.name, values, s.codecs...)
+		if err != nil {
+			return err
+		}
+		c.Value = encoded
+	}
+
+	http.SetCookie(w, &c)
+	setRequestCookie(r, s.name, c.Value)
+	return nil
+}
+
+// Get returns the value from the cookie
+func (s *CookieTokenStore) Get(r *http.Request, key string) (interface{}, error) {
+	values, err := s.values(r)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := values[key]; ok {
+		return decodeValue(b)
+	}
+	return nil, nil
+}
+
+// Set stores the value in the cookie
+func (s *CookieTokenStore) Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+	values, err := s.values(r)
+	if err != nil {
+		values = make(map[string][]byte)
+	}
+	b, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+	values[key] = b
+	return s.save(w, r, values)
+}
+
+// Delete removes the value from the cookie
+func (s *CookieTokenStore) Delete(w http.ResponseWriter, r *http.Request, key string) error {
+	values, err := s.values(r)
+	if err != nil {
+		return s.Clear(w, r)
+	}
+	if _, ok := values[key]; !ok {
+		return nil
+	}
+	delete(values, key)
+	return s.save(w, r, values)
+}
+
+// Clear removes the cookie
+func (s *CookieTokenStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	return s.save(w, r, nil)
+}
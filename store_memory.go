@@ -0,0 +1,339 @@
+package csrfbanana
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MemoryTokenStore stores the tokens in memory for the client identified by
+// a function, like the user ID from the session of the application. The
+// tokens are lost when the process restarts and aren't shared between
+// servers. Expired clients are removed in the background, and when the store
+// is full, the client that expires first is removed.
+type MemoryTokenStore struct {
+	id      func(r *http.Request) string
+	clients *clientMap
+}
+
+// NewMemoryTokenStore returns a TokenStore that keeps the tokens in memory
+// and starts removing expired clients in the background. Call Close to stop.
+// id returns the client that sent the request, or an empty string if it isn't
+// known. The tokens of a client are removed ttl after they were last stored,
+// 24 hours if zero. At most 100000 clients are kept, which can be changed
+// with MaxClients.
+func NewMemoryTokenStore(ttl time.Duration, id func(r *http.Request) string) *MemoryTokenStore {
+	o := ServerStoreOptions{TTL: ttl}.withDefaults()
+	return &MemoryTokenStore{
+		id:      id,
+		clients: newClientMap(o),
+	}
+}
+
+// MaxClients sets the maximum number of clients kept
+func (s *MemoryTokenStore) MaxClients(n int) {
+	if n < 1 {
+		panic("csrfbanana: MaxClients must be at least 1")
+	}
+	s.clients.setMax(n)
+}
+
+// Close stops removing expired clients in the background
+func (s *MemoryTokenStore) Close() {
+	s.clients.close()
+}
+
+// Len returns the number of clients stored
+func (s *MemoryTokenStore) Len() int {
+	return s.clients.len()
+}
+
+// Get returns a copy of the value, so it can be changed by the request
+func (s *MemoryTokenStore) Get(r *http.Request, key string) (interface{}, error) {
+	id := s.id(r)
+	if id == "" {
+		return nil, nil
+	}
+	return s.clients.get(id, key)
+}
+
+// Set stores a copy of the value
+func (s *MemoryTokenStore) Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+	id := s.id(r)
+	if id == "" {
+		return errNoClient
+	}
+	b, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	s.clients.store(id, key, b, true)
+	return nil
+}
+
+// Update changes the value while the client is locked. A client that isn't
+// known gets nil and can't store a value.
+func (s *MemoryTokenStore) Update(w http.ResponseWriter, r *http.Request, key string, fn func(value interface{}) interface{}) error {
+	id := s.id(r)
+	if id == "" {
+		if fn(nil) != nil {
+			return errNoClient
+		}
+		return nil
+	}
+
+	_, err := s.clients.update(id, key, true, fn)
+	return err
+}
+
+// Delete removes the value
+func (s *MemoryTokenStore) Delete(w http.ResponseWriter, r *http.Request, key string) error {
+	if id := s.id(r); id != "" {
+		s.clients.delete(id, key)
+	}
+	return nil
+}
+
+// Clear removes the values of the client
+func (s *MemoryTokenStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	if id := s.id(r); id != "" {
+		s.clients.clear(id)
+	}
+	return nil
+}
+
+// clientMap is the clients of an in-memory store, split over shards with
+// their own locks so concurrent requests don't wait on each other
+type clientMap struct {
+	ttl    time.Duration
+	shards []*clientShard
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// clientShard is the clients with IDs that hash to the same shard
+type clientShard struct {
+	mu      sync.Mutex
+	clients map[string]*memoryClient
+	max     int
+}
+
+// memoryClient is the values stored for a client
+type memoryClient struct {
+	values  map[string][]byte
+	expires time.Time
+}
+
+// newClientMap returns a clientMap and starts removing expired clients in the
+// background. The options must have the defaults filled.
+func newClientMap(o ServerStoreOptions) *clientMap {
+	m := &clientMap{
+		ttl:    o.TTL,
+		shards: make([]*clientShard, o.Shards),
+		stop:   make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = &clientShard{clients: make(map[string]*memoryClient)}
+	}
+	m.setMax(o.MaxClients)
+
+	go m.sweepEvery(o.SweepInterval)
+	return m
+}
+
+// setMax sets the maximum number of clients kept
+func (m *clientMap) setMax(n int) {
+	// Round up so the shards hold at least n together
+	max := (n + len(m.shards) - 1) / len(m.shards)
+	for _, sh := range m.shards {
+		sh.mu.Lock()
+		sh.max = max
+		sh.mu.Unlock()
+	}
+}
+
+// close stops removing expired clients in the background
+func (m *clientMap) close() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+}
+
+// sweepEvery removes the expired clients until close is called
+func (m *clientMap) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sweep()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sweep removes the expired clients from every shard
+func (m *clientMap) sweep() {
+	t := now()
+	for _, sh := range m.shards {
+		sh.mu.Lock()
+		for id, c := range sh.clients {
+			if t.After(c.expires) {
+				delete(sh.clients, id)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// len returns the number of clients stored
+func (m *clientMap) len() int {
+	n := 0
+	for _, sh := range m.shards {
+		sh.mu.Lock()
+		n += len(sh.clients)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// shard returns the shard for the client ID
+func (m *clientMap) shard(id string) *clientShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+// get returns a copy of the value stored for the client
+func (m *clientMap) get(id, key string) (interface{}, error) {
+	sh := m.shard(id)
+	sh.mu.Lock()
+	var b []byte
+	if c := sh.client(id); c != nil {
+		b = c.values[key]
+	}
+	sh.mu.Unlock()
+
+	if b == nil {
+		return nil, nil
+	}
+	return decodeValue(b)
+}
+
+// store stores the value for the client and returns true. If create is
+// false, a client that isn't stored is not added and false is returned.
+func (m *clientMap) store(id, key string, b []byte, create bool) bool {
+	sh := m.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	c := sh.client(id)
+	if c == nil {
+		if !create {
+			return false
+		}
+		c = sh.add(id)
+	}
+	c.values[key] = b
+	c.expires = now().Add(m.ttl)
+	return true
+}
+
+// update replaces the value for the client with the one fn returns while the
+// lock is held, and returns true. If create is false, a client that isn't
+// stored is not added, fn isn't called, and false is returned.
+func (m *clientMap) update(id, key string, create bool, fn func(value interface{}) interface{}) (bool, error) {
+	sh := m.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	c := sh.client(id)
+	if c == nil && !create {
+		return false, nil
+	}
+
+	var value interface{}
+	if c != nil && c.values[key] != nil {
+		v, err := decodeValue(c.values[key])
+		if err != nil {
+			return true, err
+		}
+		value = v
+	}
+
+	value = fn(value)
+	if value == nil {
+		if c != nil {
+			delete(c.values, key)
+		}
+		return true, nil
+	}
+
+	b, err := encodeValue(value)
+	if err != nil {
+		return true, err
+	}
+	if c == nil {
+		c = sh.add(id)
+	}
+	c.values[key] = b
+	c.expires = now().Add(m.ttl)
+	return true, nil
+}
+
+// delete removes the value stored for the client
+func (m *clientMap) delete(id, key string) {
+	sh := m.shard(id)
+	sh.mu.Lock()
+	if c := sh.client(id); c != nil {
+		delete(c.values, key)
+	}
+	sh.mu.Unlock()
+}
+
+// clear removes the client
+func (m *clientMap) clear(id string) {
+	sh := m.shard(id)
+	sh.mu.Lock()
+	delete(sh.clients, id)
+	sh.mu.Unlock()
+}
+
+// client returns the client with the ID if it hasn't expired. The lock must
+// be held.
+func (sh *clientShard) client(id string) *memoryClient {
+	c, ok := sh.clients[id]
+	if !ok {
+		return nil
+	}
+	if now().After(c.expires) {
+		delete(sh.clients, id)
+		return nil
+	}
+	return c
+}
+
+// add adds an empty client, removing the client that expires first if the
+// shard is full. The lock must be held.
+func (sh *clientShard) add(id string) *memoryClient {
+	for len(sh.clients) >= sh.max {
+		sh.evict()
+	}
+	c := &memoryClient{values: make(map[string][]byte)}
+	sh.clients[id] = c
+	return c
+}
+
+// evict removes the client that expires first. The lock must be held.
+func (sh *clientShard) evict() {
+	oldest := ""
+	for id, c := range sh.clients {
+		if oldest == "" || c.expires.Before(sh.clients[oldest].expires) {
+			oldest = id
+		}
+	}
+	delete(sh.clients, oldest)
+}
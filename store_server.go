@@ -0,0 +1,187 @@
+package csrfbanana
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+// ServerStoreOptions contains the settings for a ServerTokenStore. Zero fields
+// use the defaults.
+type ServerStoreOptions struct {
+	CookieName    string        // Name of the cookie with the client ID, "csrf_id" by default
+	TTL           time.Duration // How long the tokens are kept after they were last stored, 24 hours by default
+	MaxClients    int           // Maximum number of clients kept, 100000 by default
+	Shards        int           // Number of separately locked maps, 32 by default
+	SweepInterval time.Duration // How often expired clients are removed, one minute by default
+
+	// Binding returns a value of the client, like the session ID or user
+	// ID of the application, that the client ID is bound to. A client ID
+	// stored for another value isn't used, so a valid ID planted by
+	// someone else is replaced. Nil doesn't bind the ID.
+	Binding func(r *http.Request) string
+}
+
+// withDefaults fills the empty fields
+func (o ServerStoreOptions) withDefaults() ServerStoreOptions {
+	if o.CookieName == "" {
+		o.CookieName = "csrf_id"
+	}
+	if o.TTL <= 0 {
+		o.TTL = 24 * time.Hour
+	}
+	if o.MaxClients <= 0 {
+		o.MaxClients = 100000
+	}
+	if o.Shards <= 0 {
+		o.Shards = 32
+	}
+	if o.SweepInterval <= 0 {
+		o.SweepInterval = time.Minute
+	}
+	return o
+}
+
+// ServerTokenStore stores the tokens in memory, for the client with the
+// random ID in a cookie. Only the ID is sent to the browser, so the number of
+// tokens isn't limited by the size of a cookie. The clients are split over
+// shards with their own locks so concurrent requests don't wait on each
+// other. Expired clients are removed in the background, and when a shard is
+// full, the client that expires first is removed.
+type ServerTokenStore struct {
+	o       ServerStoreOptions
+	clients *clientMap
+}
+
+// NewServerTokenStore returns a ServerTokenStore and starts removing expired
+// clients in the background. Call Close to stop.
+func NewServerTokenStore(o ServerStoreOptions) *ServerTokenStore {
+	o = o.withDefaults()
+	return &ServerTokenStore{
+		o:       o,
+		clients: newClientMap(o),
+	}
+}
+
+// Close stops removing expired clients in the background
+func (s *ServerTokenStore) Close() {
+	s.clients.close()
+}
+
+// sweep removes the expired clients
+func (s *ServerTokenStore) sweep() {
+	s.clients.sweep()
+}
+
+// Len returns the number of clients stored
+func (s *ServerTokenStore) Len() int {
+	return s.clients.len()
+}
+
+// id returns the client ID from the cookie, or an empty string
+func (s *ServerTokenStore) id(r *http.Request) string {
+	c, err := r.Cookie(s.o.CookieName)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// client returns the key the client is stored under, which is the client ID
+// and the value it is bound to
+func (s *ServerTokenStore) client(r *http.Request, id string) string {
+	if s.o.Binding == nil {
+		return id
+	}
+	return id + "\x00" + s.o.Binding(r)
+}
+
+// newID sets a cookie with a new random client ID
+func (s *ServerTokenStore) newID(w http.ResponseWriter, r *http.Request) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	s.setID(w, r, id)
+	return id
+}
+
+// setID sets the cookie with the client ID. It's sent every time the tokens
+// are stored so it expires with them.
+func (s *ServerTokenStore) setID(w http.ResponseWriter, r *http.Request, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.o.CookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(s.o.TTL / time.Second),
+		Secure:   isSecure(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	setRequestCookie(r, s.o.CookieName, id)
+}
+
+// Get returns a copy of the value, so it can be changed by the request
+func (s *ServerTokenStore) Get(r *http.Request, key string) (interface{}, error) {
+	id := s.id(r)
+	if id == "" {
+		return nil, nil
+	}
+	return s.clients.get(s.client(r, id), key)
+}
+
+// Set stores a copy of the value and sends the ID cookie again, so it expires
+// TTL after the tokens were last stored like the client. A client without an
+// ID, or with an ID that isn't stored, gets a new one, so an ID made up by
+// someone else isn't used. A valid ID taken from the site can still be
+// planted in another browser unless Binding is set.
+func (s *ServerTokenStore) Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+	b, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	if id := s.id(r); id != "" && s.clients.store(s.client(r, id), key, b, false) {
+		s.setID(w, r, id)
+		return nil
+	}
+	s.clients.store(s.client(r, s.newID(w, r)), key, b, true)
+	return nil
+}
+
+// Update changes the value while the client is locked. A client without a
+// stored ID gets nil and, if a value is returned, a new ID.
+func (s *ServerTokenStore) Update(w http.ResponseWriter, r *http.Request, key string, fn func(value interface{}) interface{}) error {
+	if id := s.id(r); id != "" {
+		found, err := s.clients.update(s.client(r, id), key, false, fn)
+		if found {
+			if err == nil {
+				s.setID(w, r, id)
+			}
+			return err
+		}
+	}
+
+	value := fn(nil)
+	if value == nil {
+		return nil
+	}
+	return s.Set(w, r, key, value)
+}
+
+// Delete removes the value
+func (s *ServerTokenStore) Delete(w http.ResponseWriter, r *http.Request, key string) error {
+	if id := s.id(r); id != "" {
+		s.clients.delete(s.client(r, id), key)
+	}
+	return nil
+}
+
+// Clear removes the values of the client
+func (s *ServerTokenStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	if id := s.id(r); id != "" {
+		s.clients.clear(s.client(r, id))
+	}
+	return nil
+}
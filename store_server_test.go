@@ -0,0 +1,317 @@
+package csrfbanana
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerTokenStore(t *testing.T) {
+	store := NewServerTokenStore(ServerStoreOptions{})
+	defer store.Close()
+
+	// Store tokens for a new client
+	w := httptest.NewRecorder()
+	r := fakeGet()
+	if err := store.Set(w, r, TokenName, TokenMap{"/": TokenEntry{Value: "123456"}}); err != nil {
+		t.Fatalf("Error storing tokens: %v", err)
+	}
+
+	// Only the ID is in the cookie
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf_id" || !cookies[0].HttpOnly || len(cookies[0].Value) != 43 {
+		t.Fatalf("Wrong cookie set: %v", cookies)
+	}
+	id := cookies[0]
+
+	// The same request sees the new ID
+	if v, _ := store.Get(r, TokenName); v == nil || v.(TokenMap)["/"].Value != "123456" {
+		t.Errorf("Tokens should be stored, got %v", v)
+	}
+
+	// The next request sends the ID back
+	r = fakeGet()
+	r.AddCookie(id)
+	if v, _ := store.Get(r, TokenName); v == nil || v.(TokenMap)["/"].Value != "123456" {
+		t.Errorf("Tokens should be stored, got %v", v)
+	}
+
+	// Storing again keeps the ID and sends the cookie again to extend it
+	w = httptest.NewRecorder()
+	store.Set(w, r, TokenName, TokenMap{})
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != id.Value || cookies[0].MaxAge != 86400 {
+		t.Errorf("ID should be sent again, got %v", cookies)
+	}
+
+	// An ID that isn't stored is replaced
+	r = fakeGet()
+	r.AddCookie(&http.Cookie{Name: "csrf_id", Value: "chosen"})
+	if v, _ := store.Get(r, TokenName); v != nil {
+		t.Errorf("Unknown ID should not have tokens, got %v", v)
+	}
+	w = httptest.NewRecorder()
+	store.Set(w, r, TokenName, TokenMap{})
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Value == "chosen" {
+		t.Errorf("Unknown ID should be replaced, got %v", cookies)
+	}
+	if store.Len() != 2 {
+		t.Errorf("Expected 2 clients, got %v", store.Len())
+	}
+
+	// Clear removes the client
+	r = fakeGet()
+	r.AddCookie(id)
+	store.Clear(httptest.NewRecorder(), r)
+	if v, _ := store.Get(r, TokenName); v != nil || store.Len() != 1 {
+		t.Errorf("Client should be removed, got %v", v)
+	}
+}
+
+func TestServerTokenStoreBinding(t *testing.T) {
+	store := NewServerTokenStore(ServerStoreOptions{
+		Binding: func(r *http.Request) string {
+			c, err := r.Cookie("user")
+			if err != nil {
+				return ""
+			}
+			return c.Value
+		},
+	})
+	defer store.Close()
+
+	// request returns a request from the user with the client ID
+	request := func(user string, id *http.Cookie) *http.Request {
+		r := fakeGet()
+		r.AddCookie(&http.Cookie{Name: "user", Value: user})
+		if id != nil {
+			r.AddCookie(id)
+		}
+		return r
+	}
+
+	// Store tokens for the attacker
+	w := httptest.NewRecorder()
+	store.Set(w, request("attacker", nil), TokenName, TokenMap{"/": TokenEntry{Value: "123456"}})
+	id := w.Result().Cookies()[0]
+	if v, _ := store.Get(request("attacker", id), TokenName); v == nil {
+		t.Fatal("Tokens should be stored for the attacker")
+	}
+
+	// The ID planted in the browser of the victim has no tokens
+	if v, _ := store.Get(request("victim", id), TokenName); v != nil {
+		t.Errorf("Planted ID should not have tokens, got %v", v)
+	}
+
+	// And is replaced when the tokens of the victim are stored
+	w = httptest.NewRecorder()
+	store.Set(w, request("victim", id), TokenName, TokenMap{})
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Value == id.Value {
+		t.Errorf("Planted ID should be replaced, got %v", cookies)
+	}
+}
+
+func TestServerTokenStoreExpiry(t *testing.T) {
+	// Control the clock
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	store := NewServerTokenStore(ServerStoreOptions{TTL: time.Minute, SweepInterval: time.Hour})
+	defer store.Close()
+
+	// Store tokens for two clients
+	var ids []*http.Cookie
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		store.Set(w, fakeGet(), TokenName, TokenMap{})
+		ids = append(ids, w.Result().Cookies()[0])
+		current = current.Add(45 * time.Second)
+	}
+
+	// The first client has expired
+	r := fakeGet()
+	r.AddCookie(ids[0])
+	if v, _ := store.Get(r, TokenName); v != nil {
+		t.Errorf("Tokens should have expired, got %v", v)
+	}
+	r = fakeGet()
+	r.AddCookie(ids[1])
+	if v, _ := store.Get(r, TokenName); v == nil {
+		t.Error("Tokens should not have expired")
+	}
+
+	// The sweep removes the second client without a request
+	store.Set(httptest.NewRecorder(), fakeGet(), TokenName, TokenMap{})
+	current = current.Add(20 * time.Second)
+	store.sweep()
+	if store.Len() != 1 {
+		t.Errorf("Expected 1 client after the sweep, got %v", store.Len())
+	}
+}
+
+func TestServerTokenStoreCapacity(t *testing.T) {
+	// Control the clock
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	store := NewServerTokenStore(ServerStoreOptions{MaxClients: 4, Shards: 1})
+	defer store.Close()
+
+	// Store tokens for more clients than fit
+	var ids []*http.Cookie
+	for i := 0; i < 6; i++ {
+		w := httptest.NewRecorder()
+		store.Set(w, fakeGet(), TokenName, TokenMap{})
+		ids = append(ids, w.Result().Cookies()[0])
+		current = current.Add(time.Second)
+	}
+
+	if store.Len() != 4 {
+		t.Errorf("Expected 4 clients, got %v", store.Len())
+	}
+
+	// The clients that expire first were removed
+	for i, id := range ids {
+		r := fakeGet()
+		r.AddCookie(id)
+		v, _ := store.Get(r, TokenName)
+		if (i < 2) != (v == nil) {
+			t.Errorf("Client %v: expected removed %v, got tokens %v", i, i < 2, v)
+		}
+	}
+}
+
+// serverStoreHandler returns a handler using a ServerTokenStore and a page
+// that renders the token
+func serverStoreHandler(store *ServerTokenStore) *CSRFHandler {
+	page := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(TokenFromRequest(r)))
+	}
+
+	h := New(http.HandlerFunc(page), nil, "")
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+	h.Store(store)
+	return h
+}
+
+// serverStoreClient renders the form for a new client and returns the ID
+// cookie and token
+func serverStoreClient(h *CSRFHandler) (*http.Cookie, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+	return w.Result().Cookies()[0], w.Body.String()
+}
+
+// serverStorePost submits the token and returns the status code
+func serverStorePost(h *CSRFHandler, id *http.Cookie, token string) int {
+	form := url.Values{}
+	form.Set(TokenName, token)
+	req := fakePost(form)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(id)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestServerTokenStoreSecureBehindProxy(t *testing.T) {
+	store := NewServerTokenStore(ServerStoreOptions{})
+	defer store.Close()
+	h := serverStoreHandler(store)
+	h.TrustedProxies([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		remoteAddr string
+		secure     bool
+	}{
+		{"10.1.2.3:1234", true},
+		// The header is ignored from other addresses
+		{"192.0.2.1:1234", false},
+	}
+
+	for _, tt := range tests {
+		// The proxy terminates TLS
+		req := fakeGet()
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Secure != tt.secure {
+			t.Errorf("Remote %v: expected Secure %v, got %v", tt.remoteAddr, tt.secure, cookies)
+		}
+	}
+}
+
+func TestServerTokenStoreConcurrent(t *testing.T) {
+	store := NewServerTokenStore(ServerStoreOptions{Shards: 4})
+	defer store.Close()
+	h := serverStoreHandler(store)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, token := serverStoreClient(h)
+			for j := 0; j < 20; j++ {
+				if code := serverStorePost(h, id, token); code != 200 {
+					errs <- fmt.Errorf("client %v request %v: expected 200, got %v", i, j, code)
+					return
+				}
+				if code := serverStorePost(h, id, token+"x"); code != 500 {
+					errs <- fmt.Errorf("client %v request %v: expected 500, got %v", i, j, code)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if store.Len() != 50 {
+		t.Errorf("Expected 50 clients, got %v", store.Len())
+	}
+}
+
+func BenchmarkServerTokenStoreIssue(b *testing.B) {
+	store := NewServerTokenStore(ServerStoreOptions{})
+	defer store.Close()
+	h := serverStoreHandler(store)
+
+	b.RunParallel(func(pb *testing.PB) {
+		id, _ := serverStoreClient(h)
+		for pb.Next() {
+			r := fakeGet()
+			r.AddCookie(id)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+	})
+}
+
+func BenchmarkServerTokenStoreVerify(b *testing.B) {
+	store := NewServerTokenStore(ServerStoreOptions{})
+	defer store.Close()
+	h := serverStoreHandler(store)
+
+	b.RunParallel(func(pb *testing.PB) {
+		id, token := serverStoreClient(h)
+		for pb.Next() {
+			if code := serverStorePost(h, id, token); code != 200 {
+				b.Errorf("Expected 200, got %v", code)
+				return
+			}
+		}
+	})
+}
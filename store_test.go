@@ -0,0 +1,262 @@
+package csrfbanana
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// clientID returns the client ID from a cookie set by the application
+func clientID(r *http.Request) string {
+	c, err := r.Cookie("client")
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+func TestTokenStores(t *testing.T) {
+	stores := map[string]TokenStore{
+		"session": NewSessionTokenStore(sessions.NewCookieStore([]byte("secret-key")), "test"),
+		"cookie":  NewCookieTokenStore("csrf", []byte("secret-key")),
+		"memory":  NewMemoryTokenStore(time.Hour, clientID),
+	}
+
+	for name, store := range stores {
+		// Save the reason passed to the failure handler
+		var reason error
+		failure := func(w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(r)
+			failureHandler500(w, r)
+		}
+
+		// Render the form in the next handler
+		var token string
+		page := func(w http.ResponseWriter, r *http.Request) {
+			token = TokenFromRequest(r)
+			successHandler(w, r)
+		}
+
+		// Create the handler without a session store
+		h := New(http.HandlerFunc(page), nil, "")
+		h.FailureHandler(http.HandlerFunc(failure))
+		h.ClearAfterUsage(true)
+		h.Store(store)
+
+		// Send the cookies back with every request
+		cookies := map[string]*http.Cookie{
+			"client": {Name: "client", Value: "client1"},
+		}
+		serve := func(req *http.Request) {
+			reason = nil
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			for _, c := range w.Result().Cookies() {
+				cookies[c.Name] = c
+			}
+		}
+		post := func(token string) error {
+			form := url.Values{}
+			form.Set(TokenName, token)
+			req := fakePost(form)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(req)
+			return reason
+		}
+
+		// Render the form
+		serve(fakeGet())
+		if token == "" {
+			t.Fatalf("Store %v: token should be issued", name)
+		}
+
+		// The token works once
+		first := token
+		if err := post(first); err != nil {
+			t.Errorf("Store %v: token should be valid, got %v", name, err)
+		}
+		if err := post(first); err != ErrBadToken {
+			t.Errorf("Store %v: used token should fail with %v, got %v", name, ErrBadToken, err)
+		}
+
+		// A new token works
+		serve(fakeGet())
+		if err := post(token); err != nil || token == first {
+			t.Errorf("Store %v: new token should be valid, got %v", name, err)
+		}
+	}
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	// Control the clock
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	store := NewMemoryTokenStore(time.Minute, clientID)
+	defer store.Close()
+
+	// Create the request
+	r := fakeGet()
+	r.AddCookie(&http.Cookie{Name: "client", Value: "client1"})
+	w := httptest.NewRecorder()
+
+	if err := store.Set(w, r, TokenName, TokenMap{"/": TokenEntry{Value: "123456", Issued: now()}}); err != nil {
+		t.Fatalf("Error storing tokens: %v", err)
+	}
+
+	// A copy is returned, so changing it doesn't change the store
+	v, err := store.Get(r, TokenName)
+	if err != nil {
+		t.Fatalf("Error getting tokens: %v", err)
+	}
+	v.(TokenMap)["/"] = TokenEntry{Value: "changed"}
+	v, _ = store.Get(r, TokenName)
+	if v.(TokenMap)["/"].Value != "123456" {
+		t.Errorf("Stored token should not change, got %v", v)
+	}
+
+	// Another client doesn't have tokens
+	other := fakeGet()
+	other.AddCookie(&http.Cookie{Name: "client", Value: "client2"})
+	if v, _ := store.Get(other, TokenName); v != nil {
+		t.Errorf("Other client should not have tokens, got %v", v)
+	}
+
+	// An unknown client can't store tokens
+	if err := store.Set(w, fakeGet(), TokenName, TokenMap{}); err == nil {
+		t.Error("Storing tokens for an unknown client should fail")
+	}
+
+	// The tokens expire
+	current = current.Add(2 * time.Minute)
+	if v, _ := store.Get(r, TokenName); v != nil {
+		t.Errorf("Tokens should have expired, got %v", v)
+	}
+
+	// The sweep removes expired clients without a request
+	store.Set(w, other, TokenName, TokenMap{})
+	current = current.Add(2 * time.Minute)
+	store.clients.sweep()
+	if store.Len() != 0 {
+		t.Errorf("Expected 0 clients after the sweep, got %v", store.Len())
+	}
+}
+
+func TestMemoryTokenStoreCapacity(t *testing.T) {
+	// Control the clock
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	store := NewMemoryTokenStore(time.Hour, clientID)
+	defer store.Close()
+	store.MaxClients(1)
+
+	// Store tokens for more clients than fit
+	for i := 0; i < 100; i++ {
+		r := fakeGet()
+		r.AddCookie(&http.Cookie{Name: "client", Value: fmt.Sprint("client", i)})
+		store.Set(httptest.NewRecorder(), r, TokenName, TokenMap{})
+		current = current.Add(time.Second)
+	}
+
+	// Every shard holds at most one client
+	if n := store.Len(); n > len(store.clients.shards) {
+		t.Errorf("Expected at most %v clients, got %v", len(store.clients.shards), n)
+	}
+
+	// The last client is kept
+	r := fakeGet()
+	r.AddCookie(&http.Cookie{Name: "client", Value: "client99"})
+	if v, _ := store.Get(r, TokenName); v == nil {
+		t.Error("Last client should be kept")
+	}
+}
+
+func TestHandlerTokenWithStore(t *testing.T) {
+	// Create the handler without a session store
+	h := New(http.HandlerFunc(successHandler), nil, "")
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+	h.Store(NewMemoryTokenStore(time.Hour, clientID))
+
+	client := &http.Cookie{Name: "client", Value: "client1"}
+	post := func(token string) int {
+		form := url.Values{}
+		form.Set(TokenName, token)
+		req := fakePost(form)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(client)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Issue a token outside of ServeHTTP without a session
+	r := fakeGet()
+	r.AddCookie(client)
+	token, err := h.TokenE(httptest.NewRecorder(), r, nil)
+	if err != nil || token == "" {
+		t.Fatalf("Token should be issued, got %q, %v", token, err)
+	}
+	if code := post(token); code != http.StatusOK {
+		t.Errorf("Token should be valid, got %v", code)
+	}
+
+	// Clear the tokens without a session
+	token = h.Token(httptest.NewRecorder(), r, nil)
+	if err := h.ClearE(httptest.NewRecorder(), r, nil); err != nil {
+		t.Fatalf("Error clearing tokens: %v", err)
+	}
+	if code := post(token); code != http.StatusInternalServerError {
+		t.Errorf("Cleared token should fail, got %v", code)
+	}
+
+	// Without any store, an error is returned instead of a panic
+	h = New(http.HandlerFunc(successHandler), nil, "")
+	if _, err := h.TokenE(httptest.NewRecorder(), r, nil); err != ErrSessionUnavailable {
+		t.Errorf("Token without a store should fail with %v, got %v", ErrSessionUnavailable, err)
+	}
+	if err := h.ClearFromRequest(httptest.NewRecorder(), r); err != ErrSessionUnavailable {
+		t.Errorf("Clear without a store should fail with %v, got %v", ErrSessionUnavailable, err)
+	}
+}
+
+func TestSessionTokenStoreClear(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+	ts := NewSessionTokenStore(store, cookieName)
+
+	// Create the request
+	r := fakeGet()
+	w := httptest.NewRecorder()
+
+	// Get the session
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Set the values in the session manually
+	sess.Values["user"] = "bob"
+	sess.Values[TokenName] = TokenMap{"/": TokenEntry{Value: "123456"}}
+	sess.Values["legacy"] = StringMap{"/": "123456"}
+
+	if err := ts.Clear(w, r); err != nil {
+		t.Fatalf("Error clearing tokens: %v", err)
+	}
+
+	if len(sess.Values) != 1 || sess.Values["user"] != "bob" {
+		t.Errorf("Only the tokens should be cleared, got %v", sess.Values)
+	}
+}
@@ -0,0 +1,47 @@
+package csrfbanana
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// FuncMap contains template functions that read the token from the request
+// context, so they work in any handler behind a CSRFHandler. Pass the
+// request to them in the template:
+//
+//	<form method="post" action="/login">
+//	{{ csrfField .Request }}
+//	</form>
+//
+//	<form method="post" action="/form1">
+//	{{ csrfFieldWithPath .Request "/form1" }}
+//	</form>
+//
+//	<meta name="csrf-token" content="{{ csrfToken .Request }}">
+var FuncMap = template.FuncMap{
+	"csrfField":         csrfField,
+	"csrfFieldWithPath": csrfFieldWithPath,
+	"csrfToken":         TokenFromRequest,
+	"csrfTokenWithPath": TokenForPath,
+}
+
+// csrfField returns a hidden input with the token for the current page
+func csrfField(r *http.Request) template.HTML {
+	return hiddenField(r, TokenFromRequest(r))
+}
+
+// csrfFieldWithPath returns a hidden input with the token for the URL
+func csrfFieldWithPath(r *http.Request, urlPath string) template.HTML {
+	return hiddenField(r, TokenForPath(r, urlPath))
+}
+
+// hiddenField returns a hidden input named after the TokenName of the handler
+func hiddenField(r *http.Request, token string) template.HTML {
+	name := TokenName
+	if rt := requestTokensFrom(r); rt != nil {
+		name = rt.h.Options().TokenName
+	}
+
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(name) +
+		`" value="` + template.HTMLEscapeString(token) + `">`)
+}
@@ -0,0 +1,70 @@
+package csrfbanana
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestFuncMap(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	templ := template.Must(template.New("t").Funcs(FuncMap).Parse(
+		`{{ csrfField . }}|{{ csrfFieldWithPath . "/form1" }}|{{ csrfToken . }}|{{ csrfTokenWithPath . "/form1" }}`))
+
+	// Render the template in the page
+	var token, token1 string
+	page := func(w http.ResponseWriter, r *http.Request) {
+		if err := templ.Execute(w, r); err != nil {
+			t.Fatalf("Error executing template: %v", err)
+		}
+		token = TokenFromRequest(r)
+		token1 = TokenForPath(r, "/form1")
+	}
+
+	// Create the handler with a token name that must be escaped
+	h := New(http.HandlerFunc(page), store, cookieName, Options{TokenName: `a"b`})
+	h.FailureHandler(http.HandlerFunc(failureHandler500))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, fakeGet())
+
+	expected := `<input type="hidden" name="a&#34;b" value="` + token + `">|` +
+		`<input type="hidden" name="a&#34;b" value="` + token1 + `">|` +
+		token + `|` + token1
+	if w.Body.String() != expected {
+		t.Errorf("Wrong template output:\nexpected %v\ngot      %v", expected, w.Body.String())
+	}
+
+	// The session is saved with the rendered tokens
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("The session should have been saved, got %v", cookies)
+	}
+
+	for path, token := range map[string]string{"/": token, "/form1": token1} {
+		// Submit the form
+		form := url.Values{}
+		form.Set(`a"b`, token)
+		req, err := http.NewRequest("POST", "http://localhost"+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookies[0])
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Errorf("Rendered token for %v should be in the cookie, got %v", path, w.Code)
+		}
+	}
+}
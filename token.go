@@ -8,84 +8,184 @@ package csrfbanana
 // Revel: https://github.com/cbonello/revel-csrf
 
 import (
-	"bytes"
 	"crypto/rand"
-	"encoding/json"
-	"fmt"
-	"io"
-	"io/ioutil"
+	"crypto/subtle"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 )
 
+// Package-level defaults, used by Token, TokenWithPath, and Clear and by any
+// CSRFHandler created without Options
 var (
-	TokenLength = 32      // Length of the token
-	TokenName   = "token" // Name of the token in the session variables
-	SingleToken = false   // True is one token for entire session, false is unique token for each URL
-	MaxTokens   = 20      // Maximum number of tokens saved in a session - prevents this error: Error saving session: securecookie: the value is too long
+	TokenLength = 32             // Length of the token
+	TokenName   = "token"        // Name of the token in the session variables
+	SingleToken = false          // True is one token for entire session, false is unique token for each URL
+	MaxTokens   = 20             // Maximum number of tokens saved in a session - prevents this error: Error saving session: securecookie: the value is too long
+	TokenHeader = "X-CSRF-Token" // Name of the request header that can carry the token instead of the body
 )
 
+// defaultMultipartMaxBytes is how much of a multipart/form-data body is read
+// to find the token when Options.MultipartMaxBytes is zero
+const defaultMultipartMaxBytes = 1 << 16
+
 // Clear will remove all the tokens. Call after a permission change.
 func Clear(w http.ResponseWriter, r *http.Request, sess *sessions.Session) {
-	// Delete the map if it doesn't exist
-	if _, ok := sess.Values[TokenName]; ok {
-		delete(sess.Values, TokenName)
-		sess.Save(r, w)
-	}
+	clearTokens(w, r, sess, DefaultOptions())
+}
+
+// ClearE is like Clear, but returns the error from saving the session
+func ClearE(w http.ResponseWriter, r *http.Request, sess *sessions.Session) error {
+	return clearTokens(w, r, sess, DefaultOptions())
 }
 
 // Token will return a token. If SingleToken = true, it will return the same token for every page.
 func Token(w http.ResponseWriter, r *http.Request, sess *sessions.Session) string {
-	// Generate the map if it doesn't exist
-	if _, ok := sess.Values[TokenName]; !ok {
-		sess.Values[TokenName] = make(StringMap)
+	t, _ := token(w, r, sess, DefaultOptions())
+	return t
+}
+
+// TokenE is like Token, but returns the error from saving the session. The
+// token won't be accepted if the error is not nil.
+func TokenE(w http.ResponseWriter, r *http.Request, sess *sessions.Session) (string, error) {
+	return token(w, r, sess, DefaultOptions())
+}
+
+// TokenWithPath will return a token for the specified URL. SingleToken is ignored.
+func TokenWithPath(w http.ResponseWriter, r *http.Request, sess *sessions.Session, urlPath string) string {
+	t, _ := tokenWithPath(w, r, sess, urlPath, DefaultOptions())
+	return t
+}
+
+// TokenWithPathE is like TokenWithPath, but returns the error from saving the
+// session. The token won't be accepted if the error is not nil.
+func TokenWithPathE(w http.ResponseWriter, r *http.Request, sess *sessions.Session, urlPath string) (string, error) {
+	return tokenWithPath(w, r, sess, urlPath, DefaultOptions())
+}
+
+// clearTokens removes the token map from the session. Tokens loaded by a
+// CSRFHandler for the request are dropped too, so they aren't saved again
+// when the request ends.
+func clearTokens(w http.ResponseWriter, r *http.Request, sess *sessions.Session, o Options) error {
+	if rt := requestTokensFrom(r); rt != nil && rt.h.Options().TokenName == o.TokenName {
+		rt.forget()
 	}
 
-	path := r.URL.Path
+	// Delete the map if it doesn't exist
+	if _, ok := sess.Values[o.TokenName]; ok {
+		delete(sess.Values, o.TokenName)
+		return sess.Save(r, w)
+	}
+	return nil
+}
+
+// token returns the token for the current page, or for the session if
+// SingleToken is set
+func token(w http.ResponseWriter, r *http.Request, sess *sessions.Session, o Options) (string, error) {
+	return tokenWithPath(w, r, sess, tokenPath(r, o), o)
+}
 
-	if SingleToken {
-		path = "/"
+// tokenPath returns the path the token for the request is stored under
+func tokenPath(r *http.Request, o Options) string {
+	if o.SingleToken {
+		return "/"
 	}
+	return r.URL.Path
+}
 
-	sessMap := sess.Values[TokenName].(StringMap)
-	if _, ok := sessMap[path]; !ok {
+// tokenWithPath returns the token for urlPath, generating one if needed
+func tokenWithPath(w http.ResponseWriter, r *http.Request, sess *sessions.Session, urlPath string, o Options) (string, error) {
+	t, changed := issueToken(sess, urlPath, o)
+	if changed {
+		return t, sess.Save(r, w)
+	}
+	return t, nil
+}
 
-		if len(sessMap) >= MaxTokens {
-			for i, _ := range sessMap {
-				delete(sessMap, i)
-			}
+// issueToken returns the token for urlPath, generating one if needed. changed
+// is true if a token was generated or the tokens were converted from an older
+// format, and the session must be saved.
+func issueToken(sess *sessions.Session, urlPath string, o Options) (t string, changed bool) {
+	changed = isLegacy(sess, o)
+	sessMap := tokenMap(sess, o, true)
+
+	if entry, ok := sessMap[urlPath]; !ok || entry.expired(o) {
+
+		if !ok {
+			sessMap.evict(o.MaxTokens)
+		}
+
+		sessMap[urlPath] = TokenEntry{
+			Value:  generate(o.TokenLength),
+			Issued: now(),
 		}
+		changed = true
+	}
 
-		sessMap[path] = generate(TokenLength)
-		sess.Save(r, w)
+	if o.Masked {
+		return maskToken(sessMap[urlPath].Value), changed
 	}
 
-	return sessMap[path]
+	return sessMap[urlPath].Value, changed
 }
 
-// Token will return a token for the specified URL. SingleToken is ignored.
-func TokenWithPath(w http.ResponseWriter, r *http.Request, sess *sessions.Session, urlPath string) string {
-	// Generate the map if it doesn't exist
-	if _, ok := sess.Values[TokenName]; !ok {
-		sess.Values[TokenName] = make(StringMap)
+// tokenMap returns the tokens stored in the session. Tokens saved by older
+// versions as a StringMap are converted and stored back in the session with
+// the current time as the issue time. If create is true, a missing map is
+// added to the session, otherwise nil is returned.
+func tokenMap(sess *sessions.Session, o Options, create bool) TokenMap {
+	switch v := sess.Values[o.TokenName].(type) {
+	case TokenMap:
+		return v
+	case StringMap:
+		m := make(TokenMap, len(v))
+		issued := now()
+		for path, token := range v {
+			m[path] = TokenEntry{Value: token, Issued: issued}
+		}
+		sess.Values[o.TokenName] = m
+		return m
 	}
 
-	sessMap := sess.Values[TokenName].(StringMap)
-	if _, ok := sessMap[urlPath]; !ok {
+	if !create {
+		return nil
+	}
 
-		if len(sessMap) >= MaxTokens {
-			for i, _ := range sessMap {
-				delete(sessMap, i)
+	m := make(TokenMap)
+	sess.Values[o.TokenName] = m
+	return m
+}
+
+// isLegacy returns true if the tokens in the session were saved by an older
+// version and are converted when read, so the session must be saved
+func isLegacy(sess *sessions.Session, o Options) bool {
+	_, ok := sess.Values[o.TokenName].(StringMap)
+	return ok
+}
+
+// evict removes the least recently issued tokens until there is room for one
+// more token without going over max. Other open forms keep working.
+func (m TokenMap) evict(max int) {
+	for len(m) > 0 && len(m) >= max {
+		oldest := ""
+		for path, entry := range m {
+			if oldest == "" || entry.Issued.Before(m[oldest].Issued) ||
+				(entry.Issued.Equal(m[oldest].Issued) && path < oldest) {
+				oldest = path
 			}
 		}
-
-		sessMap[urlPath] = generate(TokenLength)
-		sess.Save(r, w)
+		delete(m, oldest)
 	}
+}
+
+// now is used for the issue time of tokens
+var now = time.Now
 
-	return sessMap[urlPath]
+// expired returns true if the token is older than MaxAge
+func (e TokenEntry) expired(o Options) bool {
+	return o.MaxAge > 0 && now().Sub(e.Issued) > o.MaxAge
 }
 
 // Generate a token
@@ -101,74 +201,138 @@ func generate(length int) string {
 	return string(bytes)
 }
 
-// If the form token matches the session token for the URL, return true
-func match(r *http.Request, sess *sessions.Session, refresh bool) bool {
+// compareTokens is used by match to compare tokens
+var compareTokens = tokensEqual
+
+// tokensEqual returns true if the tokens are the same. Tokens of different
+// lengths are rejected up front and the rest of the comparison runs in
+// constant time so the stored token can't be guessed byte by byte.
+func tokensEqual(sent, stored string) bool {
+	if len(sent) != len(stored) || len(stored) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(stored)) == 1
+}
 
-	valid := false
-	path := r.URL.Path
+// sentToken returns the token sent with the request. The header is checked
+// first and, if it is set, the body is not read at all so a token in the
+// header always takes precedence over a token in the form or JSON body.
+func sentToken(r *http.Request, o Options) string {
+	if o.HeaderName != "" {
+		if t := r.Header.Get(o.HeaderName); t != "" {
+			return t
+		}
+	}
+
+	// Token submitted via POST
+	fn := extractor(r)
+	if fn == nil {
+		if o.Strict {
+			return r.PostFormValue(o.TokenName)
+		}
+		return r.FormValue(o.TokenName)
+	}
 
-	if SingleToken {
-		path = "/"
+	// Read the body for other content types, like JSON. A missing token or
+	// one that isn't a string is ignored.
+	if t, ok := fn(r, o); ok {
+		return t
+	}
+	if o.Strict {
+		return ""
 	}
+	return r.URL.Query().Get(o.TokenName)
+}
 
-	// If tokens exists
-	if token, ok := sess.Values[TokenName]; ok {
+// checkEntry returns nil if the sent token matches the entry and it has not
+// expired
+func checkEntry(sentToken string, entry TokenEntry, o Options) error {
+	if !compareTokens(sentToken, entry.Value) {
+		return ErrBadToken
+	}
+	if entry.expired(o) {
+		return ErrExpiredToken
+	}
+	return nil
+}
 
-		// Token submitted via POST
-		sentToken := r.FormValue(TokenName)
+// readToken returns the token sent with the request with the one-time pad
+// removed if it is masked. A masked token that can't be unmasked returns
+// ErrBadToken.
+func readToken(r *http.Request, o Options) (string, error) {
+	sentToken := sentToken(r, o)
 
-		// Detect the content type
-		switch r.Header.Get("Content-Type") {
-		case "application/x-www-form-urlencoded":
-			sentToken = r.FormValue(TokenName)
-			break
-		case "application/json":
-			// Prevents throwing an error if nil
-			b := bytes.NewBuffer(make([]byte, 0))
-			body_reader := io.TeeReader(r.Body, b)
-			if r.Body == nil {
-				break
-			}
-			var t interface{}
-			decoder := json.NewDecoder(body_reader)
-			err := decoder.Decode(&t)
-
-			// If the response is JSON
-			if err == nil {
-				vals := t.(map[string]interface{})
-				// Update the token value
-				sentToken = fmt.Sprintf("%v", vals[TokenName])
-			}
-			r.Body = ioutil.NopCloser(b)
-			break
+	// Remove the one-time pad from a masked token
+	if o.Masked && sentToken != "" {
+		token, ok := unmaskToken(sentToken)
+		if !ok {
+			return "", ErrBadToken
 		}
+		sentToken = token
+	}
 
-		// If token is empty in the form, it is not valid
-		if sentToken == "" {
-			valid = false
-		} else {
-			// Check token against same page URL
-			if sentToken == token.(StringMap)[path] {
-				valid = true
-			} else {
-				// Extract the relative referer path
-				offset := strings.Index(r.Referer(), r.Host) + len(r.Host)
-
-				// Make sure no errors can be thrown
-				if offset != 0 && offset < len(r.Referer()) {
-					// Check token against previous page
-					if sentToken == token.(StringMap)[r.Referer()[offset:]] {
-						valid = true
-					}
-				}
+	return sentToken, nil
+}
 
-			}
+// match returns nil if the form token matches the session token for the URL
+func match(r *http.Request, sess *sessions.Session, o Options, refresh bool) error {
+
+	path := tokenPath(r, o)
+
+	// Token submitted via header or POST
+	sentToken, err := readToken(r, o)
+
+	// If tokens don't exist
+	tokens := tokenMap(sess, o, false)
+	if tokens == nil {
+		if sentToken == "" && err == nil {
+			return ErrMissingToken
 		}
+		return ErrBadToken
+	}
+
+	if refresh {
+		defer delete(tokens, path)
+	}
+
+	// A token that can't be unmasked fails like a wrong one
+	if err != nil {
+		return err
+	}
+
+	// If token is empty in the form, it is not valid
+	if sentToken == "" {
+		return ErrMissingToken
+	}
+
+	return checkPaths(r, path, func(p string) error {
+		return checkEntry(sentToken, tokens[p], o)
+	})
+}
 
-		if refresh {
-			delete(token.(StringMap), path)
+// checkPaths runs check for the path of the request and, if that fails, for
+// the path of the referer so a form can post to another URL
+func checkPaths(r *http.Request, path string, check func(path string) error) error {
+	// Check token against same page URL
+	err := check(path)
+	if err == nil {
+		return nil
+	}
+
+	// Extract the relative referer path
+	offset := strings.Index(r.Referer(), r.Host) + len(r.Host)
+
+	// Make sure no errors can be thrown
+	if offset != 0 && offset < len(r.Referer()) {
+		// Check token against previous page
+		refErr := check(r.Referer()[offset:])
+		if refErr == nil {
+			return nil
+		}
+		if refErr == ErrExpiredToken {
+			err = refErr
 		}
 	}
 
-	return valid
+	return err
 }
@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/gorilla/sessions"
 )
@@ -42,7 +43,7 @@ func TestToken(t *testing.T) {
 
 	token := Token(w, r, sess)
 
-	if token != sess.Values[TokenName].(StringMap)["/"] {
+	if token != sess.Values[TokenName].(TokenMap)["/"].Value {
 		t.Errorf("Tokens do not match: expected %v, got %v", sess.Values[TokenName], token)
 	}
 
@@ -70,7 +71,7 @@ func TestTokenWithPath(t *testing.T) {
 
 	token := TokenWithPath(w, r, sess, "/monkey")
 
-	if token != sess.Values[TokenName].(StringMap)["/monkey"] {
+	if token != sess.Values[TokenName].(TokenMap)["/monkey"].Value {
 		t.Errorf("Tokens do not match: expected %v, got %v", token, sess.Values[TokenName])
 	}
 }
@@ -99,7 +100,7 @@ func TestTokenWithPathMaxTokens(t *testing.T) {
 
 	token := TokenWithPath(w, r, sess, "/monkey")
 
-	if token != sess.Values[TokenName].(StringMap)["/monkey"] {
+	if token != sess.Values[TokenName].(TokenMap)["/monkey"].Value {
 		t.Errorf("Tokens do not match: expected %v, got %v", token, sess.Values[TokenName])
 	}
 }
@@ -128,7 +129,7 @@ func TestTokenMaxTokens(t *testing.T) {
 
 	token := Token(w, r, sess)
 
-	if token != sess.Values[TokenName].(StringMap)["/"] {
+	if token != sess.Values[TokenName].(TokenMap)["/"].Value {
 		t.Errorf("Tokens do not match: expected %v, got %v", token, sess.Values[TokenName])
 	}
 }
@@ -204,7 +205,7 @@ func TestMatch(t *testing.T) {
 	sess.Values[TokenName] = make(StringMap)
 	sess.Values[TokenName].(StringMap)["/"] = "123456"
 
-	if ok := match(req, sess, true); !ok {
+	if err := match(req, sess, DefaultOptions(), true); err != nil {
 		t.Error("Tokens do not match")
 	}
 }
@@ -240,7 +241,7 @@ func TestMatchReferer(t *testing.T) {
 	sess.Values[TokenName] = make(StringMap)
 	sess.Values[TokenName].(StringMap)["/loginform"] = "123456"
 
-	if ok := match(req, sess, true); !ok {
+	if err := match(req, sess, DefaultOptions(), true); err != nil {
 		t.Error("Tokens do not match")
 	}
 }
@@ -276,7 +277,7 @@ func TestMatchRefererFail(t *testing.T) {
 	sess.Values[TokenName] = make(StringMap)
 	sess.Values[TokenName].(StringMap)["/loginform"] = "123456"
 
-	if ok := match(req, sess, true); ok {
+	if err := match(req, sess, DefaultOptions(), true); err == nil {
 		t.Error("Tokens should not match")
 	}
 }
@@ -479,3 +480,348 @@ func TestClear(t *testing.T) {
 		t.Errorf("StringMap should not exist: expected %v, got %v", nil, reflect.TypeOf(sess.Values[TokenName]))
 	}
 }
+
+func TestTokensEqual(t *testing.T) {
+	tests := []struct {
+		sent   string
+		stored string
+		equal  bool
+	}{
+		{"123456", "123456", true},
+		{"123456", "123457", false},
+		{"12345", "123456", false},
+		{"1234567", "123456", false},
+		{"", "", false},
+		{"123456", "", false},
+	}
+
+	for _, tt := range tests {
+		if tokensEqual(tt.sent, tt.stored) != tt.equal {
+			t.Errorf("tokensEqual(%q, %q) should be %v", tt.sent, tt.stored, tt.equal)
+		}
+	}
+}
+
+func TestMatchConstantTime(t *testing.T) {
+	var cookieName = "test"
+
+	// Count the calls to the constant time comparison
+	calls := 0
+	compareTokens = func(sent, stored string) bool {
+		calls++
+		return tokensEqual(sent, stored)
+	}
+	defer func() { compareTokens = tokensEqual }()
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the form
+	form := url.Values{}
+	form.Set(TokenName, "123456")
+
+	// Create the POST request
+	req, err := http.NewRequest("POST", "http://localhost/login", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", "http://localhost/loginform")
+
+	// Get the session
+	sess, err := store.Get(req, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Set the values in the session manually
+	sess.Values[TokenName] = make(StringMap)
+	sess.Values[TokenName].(StringMap)["/loginform"] = "123456"
+
+	if err := match(req, sess, DefaultOptions(), false); err != nil {
+		t.Error("Tokens do not match")
+	}
+
+	// Both the same page and the referer page are compared
+	if calls != 2 {
+		t.Errorf("Wrong number of constant time comparisons: expected %d, got %d", 2, calls)
+	}
+}
+
+func benchmarkTokensEqual(b *testing.B, sent, stored string) {
+	for i := 0; i < b.N; i++ {
+		tokensEqual(sent, stored)
+	}
+}
+
+func BenchmarkTokensEqualMatch(b *testing.B) {
+	token := generate(TokenLength)
+	benchmarkTokensEqual(b, token, token)
+}
+
+func BenchmarkTokensEqualFirstByte(b *testing.B) {
+	token := generate(TokenLength)
+	benchmarkTokensEqual(b, "!"+token[1:], token)
+}
+
+func BenchmarkTokensEqualLastByte(b *testing.B) {
+	token := generate(TokenLength)
+	benchmarkTokensEqual(b, token[:len(token)-1]+"!", token)
+}
+
+func TestTokenMaxAge(t *testing.T) {
+	var cookieName = "test"
+
+	// Control the clock
+	current := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler with tokens that expire after an hour
+	o := Options{MaxAge: time.Hour}
+	h := New(http.HandlerFunc(successHandler), store, cookieName, o)
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Create the request
+	r := fakeGet()
+
+	// Get the session
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	token1 := h.Token(w, r, sess)
+
+	// Still valid
+	current = current.Add(59 * time.Minute)
+	if token2 := h.Token(w, r, sess); token1 != token2 {
+		t.Errorf("Tokens should match: expected %v, got %v", token1, token2)
+	}
+
+	// Expired so a new one is issued
+	current = current.Add(2 * time.Minute)
+	token3 := h.Token(w, r, sess)
+	if token1 == token3 {
+		t.Error("Tokens should not match")
+	}
+
+	entry := sess.Values[TokenName].(TokenMap)["/"]
+	if entry.Value != token3 || !entry.Issued.Equal(current) {
+		t.Errorf("Wrong entry: expected %v issued at %v, got %v", token3, current, entry)
+	}
+}
+
+func TestMatchExpired(t *testing.T) {
+	var cookieName = "test"
+
+	// Control the clock
+	current := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the form
+	form := url.Values{}
+	form.Set(TokenName, "123456")
+
+	// Create the POST request
+	req := fakePost(form)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Get the session
+	sess, err := store.Get(req, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Set the values in the session manually
+	sess.Values[TokenName] = TokenMap{
+		"/": TokenEntry{Value: "123456", Issued: current.Add(-2 * time.Hour)},
+	}
+
+	if err := match(req, sess, Options{TokenName: TokenName, MaxAge: time.Hour}, false); err != ErrExpiredToken {
+		t.Errorf("Wrong error: expected %v, got %v", ErrExpiredToken, err)
+	}
+
+	if err := match(req, sess, Options{TokenName: TokenName}, false); err != nil {
+		t.Errorf("Token without MaxAge should not expire, but got %v", err)
+	}
+}
+
+func TestStringMapSession(t *testing.T) {
+	var cookieName = "test"
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Save a session in the old format
+	r := fakeGet()
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	sess.Values[TokenName] = StringMap{"/": "123456"}
+	if err := sess.Save(r, w); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+
+	// Read the cookie back in a new request
+	r2 := fakeGet()
+	r2.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+	sess2, err := store.Get(r2, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	w2 := httptest.NewRecorder()
+	if token := Token(w2, r2, sess2); token != "123456" {
+		t.Errorf("Tokens do not match: expected %v, got %v", "123456", token)
+	}
+
+	// The converted tokens are saved with their issue time
+	if len(w2.Result().Cookies()) != 1 {
+		t.Errorf("Converted session should have been saved, got %v", w2.Result().Cookies())
+	}
+
+	if _, ok := sess2.Values[TokenName].(TokenMap); !ok {
+		t.Errorf("Session should have been converted to a TokenMap, got %v", reflect.TypeOf(sess2.Values[TokenName]))
+	}
+}
+
+func TestStringMapSessionMaxAge(t *testing.T) {
+	var cookieName = "test"
+
+	// Control the clock
+	current := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the handler with tokens that expire after an hour
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(TokenFromRequest(r)))
+	}), store, cookieName, Options{MaxAge: time.Hour})
+
+	// Save a session in the old format
+	w := httptest.NewRecorder()
+	r := fakeGet()
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	sess.Values[TokenName] = StringMap{"/": "123456"}
+	if err := sess.Save(r, w); err != nil {
+		t.Fatalf("Error saving session: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	// serve runs the request with the session cookie and keeps the new one
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			cookie = cookies[len(cookies)-1]
+		}
+		return w
+	}
+
+	// The legacy token works and the converted tokens are saved
+	form := url.Values{}
+	form.Set(TokenName, "123456")
+	post := fakePost(form)
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serve(post); w.Code != 200 || len(w.Result().Cookies()) == 0 {
+		t.Fatalf("Legacy token should be accepted and converted, got %v and %v", w.Code, w.Result().Cookies())
+	}
+
+	// Still valid
+	current = current.Add(30 * time.Minute)
+	if token := serve(fakeGet()).Body.String(); token != "123456" {
+		t.Errorf("Legacy token should still be valid, got %v", token)
+	}
+
+	// Expired an hour after it was first read
+	current = current.Add(2 * time.Hour)
+	if token := serve(fakeGet()).Body.String(); token == "123456" || token == "" {
+		t.Errorf("Legacy token should have expired, got %v", token)
+	}
+}
+
+func TestTokenWithPathEviction(t *testing.T) {
+	var cookieName = "test"
+
+	// Control the clock
+	current := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	// Create a cookiestore
+	store := sessions.NewCookieStore([]byte("secret-key"))
+
+	// Create the recorder
+	w := httptest.NewRecorder()
+
+	// Create the request
+	r := fakeGet()
+
+	// Get the session
+	sess, err := store.Get(r, cookieName)
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+
+	// Fill the map, one token per second
+	tokens := make(map[string]string)
+	for i := 0; i < MaxTokens; i++ {
+		path := fmt.Sprintf("/monkey%v", i)
+		tokens[path] = TokenWithPath(w, r, sess, path)
+		current = current.Add(time.Second)
+	}
+
+	// Requesting an existing token does not evict anything
+	TokenWithPath(w, r, sess, "/monkey5")
+
+	// One more token only removes the oldest
+	tokens["/monkey"] = TokenWithPath(w, r, sess, "/monkey")
+
+	sessMap := sess.Values[TokenName].(TokenMap)
+	if len(sessMap) != MaxTokens {
+		t.Errorf("Wrong number of tokens: expected %d, got %d", MaxTokens, len(sessMap))
+	}
+
+	for path, token := range tokens {
+		entry, ok := sessMap[path]
+		if path == "/monkey0" {
+			if ok {
+				t.Errorf("Token for %v should have been evicted", path)
+			}
+			continue
+		}
+		if !ok || entry.Value != token {
+			t.Errorf("Token for %v should have survived: expected %v, got %v", path, token, entry.Value)
+		}
+	}
+
+	// Fill up again, the next oldest goes next
+	TokenWithPath(w, r, sess, "/gorilla")
+	if _, ok := sessMap["/monkey1"]; ok {
+		t.Error("Token for /monkey1 should have been evicted")
+	}
+	if _, ok := sessMap["/monkey2"]; !ok {
+		t.Error("Token for /monkey2 should have survived")
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"net/http"
 	"net/url"
+	"testing"
+
+	"github.com/gorilla/sessions"
 )
 
 func fakeGet() *http.Request {
@@ -31,3 +34,34 @@ func failureHandler500(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(500)
 	w.Write([]byte("error"))
 }
+
+func mustParseURL(t *testing.T, rawurl string) *url.URL {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// failingStore is a sessions.Store that returns errors
+type failingStore struct {
+	getErr  error
+	saveErr error
+	saves   int
+}
+
+func (s *failingStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return s.New(r, name)
+}
+
+func (s *failingStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	sess.Options = &sessions.Options{Path: "/"}
+	sess.IsNew = true
+	return sess, s.getErr
+}
+
+func (s *failingStore) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	s.saves++
+	return s.saveErr
+}